@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/pedramktb/go-ctxslog"
@@ -16,11 +18,15 @@ import (
 // It sets the timezone to UTC and configures the maximum number of CPU cores to use based on the container's limits.
 //
 // The function returns a context that should be used throughout the application, a cancel function to trigger shutdown,
-// and a channel that will receive any errors that occur during shutdown.
+// and a channel that will receive any errors that occur during shutdown. Resources that go-odj ties to the context,
+// such as Postgres pools, are released after the closers registered with the lifecycle have finished, e.g. after an
+// HTTP server has drained its requests, and the channel is closed once they are released too.
 func Bootstrap() (context.Context, context.CancelFunc, <-chan error) {
 	_ = os.Setenv("TZ", "UTC")
 
-	ctx, cancel, shutdownErrs := lifecycle.ContextFrom(Logging(context.Background()), time.Minute)
+	ctx, cancel, lifecycleErrs := lifecycle.ContextFrom(Logging(context.Background()), time.Minute)
+	hooks := &shutdownHooks{}
+	ctx = context.WithValue(ctx, shutdownCtxKey{}, hooks)
 
 	if _, err := maxprocs.Set(maxprocs.Logger(func(s string, i ...any) {
 		ctxslog.FromContext(ctx).InfoContext(ctx, fmt.Sprintf(s, i...))
@@ -28,5 +34,64 @@ func Bootstrap() (context.Context, context.CancelFunc, <-chan error) {
 		ctxslog.FromContext(ctx).ErrorContext(ctx, "failed to set maxprocs", slog.Any("err", err))
 	}
 
+	shutdownErrs := make(chan error)
+	go func() {
+		defer close(shutdownErrs)
+		<-ctx.Done()
+		if lifecycleErrs != nil {
+			for err := range lifecycleErrs {
+				shutdownErrs <- err
+			}
+		}
+		for _, err := range hooks.run(context.WithoutCancel(ctx), time.Minute) {
+			shutdownErrs <- err
+		}
+	}()
+
 	return ctx, cancel, shutdownErrs
 }
+
+type shutdownCtxKey struct{}
+
+// shutdownHooks are the release functions of the resources tied to the context returned by Bootstrap.
+type shutdownHooks struct {
+	mu      sync.Mutex
+	fns     []func(ctx context.Context) error
+	running bool
+}
+
+// run calls the hooks in reverse order of registration, so that resources are released before those they depend on,
+// and returns their errors. The context passed to them ends after timeout.
+func (h *shutdownHooks) run(ctx context.Context, timeout time.Duration) []error {
+	h.mu.Lock()
+	h.running = true
+	fns := h.fns
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var errs []error
+	for _, fn := range slices.Backward(fns) {
+		if err := fn(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// onShutdown registers fn to be called at shutdown, provided ctx derives from the context returned by Bootstrap.
+// fn runs after the closers registered with the lifecycle have finished and before the shutdown error channel
+// returned by Bootstrap is closed, which receives its error. It reports whether fn was registered.
+func onShutdown(ctx context.Context, fn func(ctx context.Context) error) bool {
+	h, ok := ctx.Value(shutdownCtxKey{}).(*shutdownHooks)
+	if !ok {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.running {
+		return false
+	}
+	h.fns = append(h.fns, fn)
+	return true
+}
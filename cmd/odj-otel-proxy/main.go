@@ -0,0 +1,221 @@
+// Command odj-otel-proxy serves the OTLP/HTTP trace proxy of go-odj as a stand-alone service,
+// so it can be deployed as a sidecar or shared service without writing any code.
+//
+// It is configured entirely through environment variables:
+//
+//	OTEL_PROXY_ADDR                 address to listen on, defaults to ":8080"
+//	OTEL_PROXY_SRC_COMPONENT        service.name enforced on all proxied spans (required)
+//	OTEL_PROXY_ENDPOINT             gRPC collector endpoint (required)
+//	OTEL_PROXY_USER                 gRPC collector basic auth user (required)
+//	OTEL_PROXY_PASS                 gRPC collector basic auth password (required)
+//	OTEL_PROXY_BUFFER_SIZE          enables background batching with a queue of this many spans
+//	OTEL_PROXY_BATCH_SIZE           maximum spans per batch when buffering
+//	OTEL_PROXY_BATCH_TIMEOUT        maximum time a span waits in the queue, e.g. "5s"
+//	OTEL_PROXY_SPILL_DIR            directory to spill undeliverable batches into when buffering
+//	OTEL_PROXY_SPILL_MAX_BYTES      size of the spilled batches per collector above which the oldest are dropped
+//	OTEL_PROXY_STRIP_URL_QUERY      strips query strings from URL attributes if "true"
+//	OTEL_PROXY_REDACT_KEYS          comma separated attribute keys whose values are redacted
+//	OTEL_PROXY_DROP_ATTRIBUTES      comma separated attribute keys that are dropped
+//	OTEL_PROXY_DEBUG_SAMPLE_RATE    fraction of payloads summarized in debug logs
+//	OTEL_PROXY_SHUTDOWN_TIMEOUT     time to drain requests and buffers on shutdown, defaults to "30s"
+//
+// The ODJ_EE_* variables are read as in every other go-odj based service.
+// /liveness, /readiness and /info serve the build information of the proxy.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pedramktb/go-ctxslog"
+	odj "github.com/pedramktb/go-odj"
+)
+
+func main() {
+	ctx, cancel, shutdownErrs := odj.Bootstrap()
+	logger := ctxslog.FromContext(ctx)
+
+	err := run(ctx)
+	if err != nil {
+		logger.ErrorContext(ctx, "otel proxy failed", slog.Any("err", err))
+	}
+
+	cancel()
+	for err := range shutdownErrs {
+		logger.ErrorContext(ctx, "shutdown error", slog.Any("err", err))
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context) error {
+	logger := ctxslog.FromContext(ctx)
+
+	opts, err := proxyOptions()
+	if err != nil {
+		return err
+	}
+	opts = append(opts, odj.OtelProxyWithContext(ctx))
+	shutdownTimeout, err := envDuration("OTEL_PROXY_SHUTDOWN_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return err
+	}
+
+	proxy, err := odj.NewOtelTraceProxy(
+		os.Getenv("OTEL_PROXY_SRC_COMPONENT"),
+		os.Getenv("OTEL_PROXY_ENDPOINT"),
+		os.Getenv("OTEL_PROXY_USER"),
+		os.Getenv("OTEL_PROXY_PASS"),
+		opts...,
+	)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /liveness", odj.InfoHandler())
+	mux.HandleFunc("GET /readiness", odj.InfoHandler())
+	mux.HandleFunc("GET /info", odj.InfoHandler())
+	mux.Handle("/", proxy)
+
+	addr := os.Getenv("OTEL_PROXY_ADDR")
+	if addr == "" {
+		addr = ":8080"
+	}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+
+	signalCtx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		logger.InfoContext(ctx, "otel proxy listening", slog.String("addr", addr))
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		_ = proxy.Shutdown(context.Background())
+		return err
+	case <-signalCtx.Done():
+	}
+
+	logger.InfoContext(ctx, "shutting down otel proxy")
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+	defer cancel()
+
+	// Stop taking requests first, then flush whatever the proxy still buffers.
+	var errs []error
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to shut down http server: %w", err))
+	}
+	if err := proxy.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to shut down otel proxy: %w", err))
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func proxyOptions() ([]odj.OtelProxyOption, error) {
+	var opts []odj.OtelProxyOption
+
+	if size := os.Getenv("OTEL_PROXY_BUFFER_SIZE"); size != "" {
+		queueSize, err := strconv.Atoi(size)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTEL_PROXY_BUFFER_SIZE: %w", err)
+		}
+		batchSize, err := envInt("OTEL_PROXY_BATCH_SIZE")
+		if err != nil {
+			return nil, err
+		}
+		batchTimeout, err := envDuration("OTEL_PROXY_BATCH_TIMEOUT", 0)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, odj.OtelProxyWithBuffer(queueSize, batchSize, batchTimeout))
+		if dir := os.Getenv("OTEL_PROXY_SPILL_DIR"); dir != "" {
+			opts = append(opts, odj.OtelProxyWithSpillDir(dir))
+		}
+		spillLimit, err := envInt("OTEL_PROXY_SPILL_MAX_BYTES")
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, odj.OtelProxyWithSpillLimit(int64(spillLimit)))
+	}
+
+	var processors []odj.OtelProxyProcessor
+	if keys := envList("OTEL_PROXY_DROP_ATTRIBUTES"); len(keys) > 0 {
+		processors = append(processors, odj.OtelProxyDropAttributes(keys...))
+	}
+	if keys := envList("OTEL_PROXY_REDACT_KEYS"); len(keys) > 0 {
+		processors = append(processors, odj.OtelProxyRedactKeys(keys...))
+	}
+	if os.Getenv("OTEL_PROXY_STRIP_URL_QUERY") == "true" {
+		processors = append(processors, odj.OtelProxyStripURLQuery())
+	}
+	if len(processors) > 0 {
+		opts = append(opts, odj.OtelProxyWithProcessors(processors...))
+	}
+
+	if rate := os.Getenv("OTEL_PROXY_DEBUG_SAMPLE_RATE"); rate != "" {
+		r, err := strconv.ParseFloat(rate, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTEL_PROXY_DEBUG_SAMPLE_RATE: %w", err)
+		}
+		opts = append(opts, odj.OtelProxyWithDebugSampling(r))
+	}
+
+	return opts, nil
+}
+
+func envInt(key string) (int, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return i, nil
+}
+
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
+
+func envList(key string) []string {
+	var list []string
+	for item := range strings.SplitSeq(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -2,10 +2,12 @@ package odj
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"os"
 
 	"github.com/pedramktb/go-ctxslog"
+	"github.com/pedramktb/go-tagerr"
 	"go.opentelemetry.io/otel/trace"
 )
 
@@ -28,6 +30,19 @@ func Logging(ctx context.Context) context.Context {
 	)
 }
 
+// recoverAsErr recovers a panic and stores it in err as an internal tagerr error carrying the stack trace of the panic,
+// and logs it. It must be deferred directly by the function whose panics it recovers. what identifies the code that
+// panicked, e.g. slog.String("job", name), and is added to the error message and the log.
+func recoverAsErr(ctx context.Context, what slog.Attr, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	tagErr := tagerr.ErrInternal.Wrap(fmt.Errorf("panic in %s %s: %v", what.Key, what.Value, r)).WithStack()
+	ctxslog.FromContext(ctx).ErrorContext(ctx, "recovered panic", what, slog.Any("err", tagErr), slog.String("stack_trace", tagErr.Stack()))
+	*err = tagErr
+}
+
 var slogHandler = func() slog.Handler {
 	var handler slog.Handler
 	switch Stage {
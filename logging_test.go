@@ -0,0 +1,38 @@
+package odj
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/pedramktb/go-tagerr"
+)
+
+func TestRecoverAsErr(t *testing.T) {
+	run := func(fn func() error) (err error) {
+		defer recoverAsErr(context.Background(), slog.String("job", "sync"), &err)
+		return fn()
+	}
+
+	sentinel := errors.New("failed")
+	if err := run(func() error { return sentinel }); err != sentinel {
+		t.Errorf("got error %v, want the returned error unchanged", err)
+	}
+	if err := run(func() error { return nil }); err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+
+	err := run(func() error { panic("boom") })
+	var tagErr *tagerr.Err
+	if !errors.As(err, &tagErr) {
+		t.Fatalf("got error %v, want a tagerr error", err)
+	}
+	if !strings.Contains(err.Error(), "panic in job sync: boom") {
+		t.Errorf("got error %q, want it to name the job and the panic", err)
+	}
+	if !strings.Contains(tagErr.Stack(), "TestRecoverAsErr") {
+		t.Errorf("got stack trace %q, want it to contain the panicking function", tagErr.Stack())
+	}
+}
@@ -0,0 +1,280 @@
+// Package odjtest provides test doubles for the infrastructure go-odj talks to.
+package odjtest
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Collector is an in-process fake OTLP gRPC collector. It implements the trace, metrics and logs services,
+// records every request it receives together with its metadata and answers with an empty response,
+// unless an error was set with SetError.
+type Collector struct {
+	server   *grpc.Server
+	listener net.Listener
+	bufconn  *bufconn.Listener
+
+	mu       sync.Mutex
+	traces   []*coltracepb.ExportTraceServiceRequest
+	metrics  []*colmetricspb.ExportMetricsServiceRequest
+	logs     []*collogspb.ExportLogsServiceRequest
+	metadata []metadata.MD
+	err      error
+}
+
+// NewCollector starts a Collector listening on a random local TCP port, e.g. to point NewOtelTraceProxy or
+// OtelTraceGRPCBasicAuthExporter at Endpoint(). The collector is stopped when the test finishes.
+func NewCollector(t testing.TB) *Collector {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen for fake collector: %v", err)
+	}
+	return newCollector(t, lis)
+}
+
+// NewBufconnCollector starts a Collector on an in-memory connection. Clients reach it with DialOptions.
+// The collector is stopped when the test finishes.
+func NewBufconnCollector(t testing.TB) *Collector {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	c := newCollector(t, lis)
+	c.bufconn = lis
+	return c
+}
+
+func newCollector(t testing.TB, lis net.Listener) *Collector {
+	c := &Collector{
+		server:   grpc.NewServer(),
+		listener: lis,
+	}
+	coltracepb.RegisterTraceServiceServer(c.server, traceService{Collector: c})
+	colmetricspb.RegisterMetricsServiceServer(c.server, metricsService{Collector: c})
+	collogspb.RegisterLogsServiceServer(c.server, logsService{Collector: c})
+	go func() { _ = c.server.Serve(lis) }()
+	t.Cleanup(c.server.Stop)
+	return c
+}
+
+// Endpoint returns the host:port the collector listens on.
+func (c *Collector) Endpoint() string {
+	return c.listener.Addr().String()
+}
+
+// DialOptions returns the options a gRPC client needs to reach the collector, for both TCP and bufconn collectors.
+// The target passed to grpc.NewClient should be Endpoint(), or "passthrough:///bufnet" for a bufconn collector.
+func (c *Collector) DialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if c.bufconn != nil {
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return c.bufconn.DialContext(ctx)
+		}))
+	}
+	return opts
+}
+
+// SetError makes every following export fail with err, e.g. a status.Error(codes.Unavailable, ...).
+// Failed exports are still recorded. Passing nil makes exports succeed again.
+func (c *Collector) SetError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+type traceService struct {
+	*Collector
+	coltracepb.UnimplementedTraceServiceServer
+}
+
+func (s traceService) Export(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	if err := s.record(ctx, func() { s.traces = append(s.traces, req) }); err != nil {
+		return nil, err
+	}
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+type metricsService struct {
+	*Collector
+	colmetricspb.UnimplementedMetricsServiceServer
+}
+
+func (s metricsService) Export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	if err := s.record(ctx, func() { s.metrics = append(s.metrics, req) }); err != nil {
+		return nil, err
+	}
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+type logsService struct {
+	*Collector
+	collogspb.UnimplementedLogsServiceServer
+}
+
+func (s logsService) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	if err := s.record(ctx, func() { s.logs = append(s.logs, req) }); err != nil {
+		return nil, err
+	}
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+func (c *Collector) record(ctx context.Context, add func()) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	add()
+	c.metadata = append(c.metadata, md.Copy())
+	return c.err
+}
+
+// TraceRequests returns all trace export requests received so far.
+func (c *Collector) TraceRequests() []*coltracepb.ExportTraceServiceRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.traces)
+}
+
+// MetricsRequests returns all metrics export requests received so far.
+func (c *Collector) MetricsRequests() []*colmetricspb.ExportMetricsServiceRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.metrics)
+}
+
+// LogsRequests returns all logs export requests received so far.
+func (c *Collector) LogsRequests() []*collogspb.ExportLogsServiceRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.logs)
+}
+
+// Metadata returns the gRPC metadata of all requests received so far, in order, across all services.
+func (c *Collector) Metadata() []metadata.MD {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.metadata)
+}
+
+// Authorizations returns the authorization header of every request received so far, e.g. "Basic dXNlcjpwYXNz".
+func (c *Collector) Authorizations() []string {
+	var auths []string
+	for _, md := range c.Metadata() {
+		auths = append(auths, md.Get("authorization")...)
+	}
+	return auths
+}
+
+// ExportedSpan is a span received by the collector together with the resource it was exported with.
+type ExportedSpan struct {
+	*tracepb.Span
+	Resource []*commonpb.KeyValue
+}
+
+// Spans returns all spans received so far.
+func (c *Collector) Spans() []ExportedSpan {
+	var spans []ExportedSpan
+	for _, req := range c.TraceRequests() {
+		for _, rs := range req.GetResourceSpans() {
+			for _, ss := range rs.GetScopeSpans() {
+				for _, span := range ss.GetSpans() {
+					spans = append(spans, ExportedSpan{Span: span, Resource: rs.GetResource().GetAttributes()})
+				}
+			}
+		}
+	}
+	return spans
+}
+
+// FindSpan returns the first received span with the given name that has all of the given span attributes.
+func (c *Collector) FindSpan(name string, attrs ...attribute.KeyValue) (ExportedSpan, bool) {
+	for _, span := range c.Spans() {
+		if span.GetName() == name && HasAttributes(span.GetAttributes(), attrs...) {
+			return span, true
+		}
+	}
+	return ExportedSpan{}, false
+}
+
+// RequireSpan waits up to timeout for a span with the given name and span attributes to be exported
+// and fails the test if none arrives. Exporters usually batch, so a short wait is needed after ending a span.
+func (c *Collector) RequireSpan(t testing.TB, timeout time.Duration, name string, attrs ...attribute.KeyValue) ExportedSpan {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		if span, ok := c.FindSpan(name, attrs...); ok {
+			return span
+		}
+		if time.Now().After(deadline) {
+			var names []string
+			for _, span := range c.Spans() {
+				names = append(names, span.GetName())
+			}
+			t.Fatalf("no span named %q with attributes %v was exported, got spans %q", name, attrs, names)
+			return ExportedSpan{}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// RequireAuthorization fails the test unless every request received so far carried the given authorization header.
+func (c *Collector) RequireAuthorization(t testing.TB, want string) {
+	t.Helper()
+	mds := c.Metadata()
+	if len(mds) == 0 {
+		t.Fatalf("no requests were received")
+	}
+	for i, md := range mds {
+		if got := md.Get("authorization"); len(got) != 1 || got[0] != want {
+			t.Fatalf("request %d has authorization %q, want %q", i, got, want)
+		}
+	}
+}
+
+// HasAttributes reports whether attrs contains every one of want with an equal value.
+func HasAttributes(attrs []*commonpb.KeyValue, want ...attribute.KeyValue) bool {
+	for _, w := range want {
+		if !slices.ContainsFunc(attrs, func(kv *commonpb.KeyValue) bool {
+			return kv.GetKey() == string(w.Key) && anyValueEqual(kv.GetValue(), w.Value)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+func anyValueEqual(v *commonpb.AnyValue, want attribute.Value) bool {
+	switch want.Type() {
+	case attribute.STRING:
+		return v.GetStringValue() == want.AsString()
+	case attribute.BOOL:
+		b, ok := v.GetValue().(*commonpb.AnyValue_BoolValue)
+		return ok && b.BoolValue == want.AsBool()
+	case attribute.INT64:
+		i, ok := v.GetValue().(*commonpb.AnyValue_IntValue)
+		return ok && i.IntValue == want.AsInt64()
+	case attribute.FLOAT64:
+		f, ok := v.GetValue().(*commonpb.AnyValue_DoubleValue)
+		return ok && f.DoubleValue == want.AsFloat64()
+	case attribute.STRINGSLICE:
+		values := v.GetArrayValue().GetValues()
+		return slices.EqualFunc(values, want.AsStringSlice(), func(a *commonpb.AnyValue, b string) bool {
+			return a.GetStringValue() == b
+		})
+	default:
+		return false
+	}
+}
@@ -0,0 +1,223 @@
+package odjtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pedramktb/go-odj"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func basicAuth(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+func TestCollectorWithExporter(t *testing.T) {
+	c := NewCollector(t)
+	ctx := context.Background()
+
+	exporter, err := odj.OtelTraceGRPCBasicAuthExporter(ctx, c.Endpoint(), "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	_, span := tp.Tracer("test").Start(ctx, "checkout")
+	span.SetAttributes(attribute.String("order.id", "42"), attribute.Int64("items", 3))
+	span.End()
+	if err := tp.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	c.RequireSpan(t, 5*time.Second, "checkout", attribute.String("order.id", "42"), attribute.Int64("items", 3))
+	c.RequireAuthorization(t, basicAuth("user", "pass"))
+}
+
+func TestCollectorWithProxy(t *testing.T) {
+	c := NewCollector(t)
+	proxy, err := odj.NewOtelTraceProxy("web-shop", c.Endpoint(), "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = proxy.Shutdown(context.Background()) })
+
+	body, err := proto.Marshal(&coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{
+		ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{{
+			TraceId:    bytes.Repeat([]byte{1}, 16),
+			SpanId:     bytes.Repeat([]byte{2}, 8),
+			Name:       "page load",
+			Attributes: []*commonpb.KeyValue{{Key: "page", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "/cart"}}}},
+		}}}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/v1/traces", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d from proxy, want 200: %s", w.Code, w.Body)
+	}
+
+	span := c.RequireSpan(t, 5*time.Second, "page load", attribute.String("page", "/cart"))
+	if !HasAttributes(span.Resource, attribute.String("service.name", "web-shop")) {
+		t.Errorf("span was exported without the proxy's service.name, got resource %v", span.Resource)
+	}
+	c.RequireAuthorization(t, basicAuth("user", "pass"))
+}
+
+func TestBufconnCollector(t *testing.T) {
+	c := NewBufconnCollector(t)
+	conn, err := grpc.NewClient("passthrough:///bufnet", c.DialOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	client := coltracepb.NewTraceServiceClient(conn)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer token")
+	req := &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{
+		ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{{Name: "a"}}}},
+	}}}
+
+	if _, err := client.Export(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	c.SetError(status.Error(codes.Unavailable, "down"))
+	if _, err := client.Export(ctx, req); status.Code(err) != codes.Unavailable {
+		t.Fatalf("got error %v, want the set Unavailable error", err)
+	}
+	c.SetError(nil)
+
+	// Failed exports are recorded too.
+	if got := len(c.TraceRequests()); got != 2 {
+		t.Errorf("got %d trace requests, want 2", got)
+	}
+	if got := c.Authorizations(); len(got) != 2 || got[0] != "Bearer token" {
+		t.Errorf("got authorizations %q, want the bearer token twice", got)
+	}
+	c.RequireAuthorization(t, "Bearer token")
+}
+
+func TestCollectorFindSpan(t *testing.T) {
+	c := NewBufconnCollector(t)
+	c.traces = append(c.traces, &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{
+		ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{
+			{Name: "query", Attributes: []*commonpb.KeyValue{{Key: "db", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "users"}}}}},
+			{Name: "query", Attributes: []*commonpb.KeyValue{{Key: "db", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "orders"}}}}},
+		}}},
+	}}})
+
+	tests := []struct {
+		name   string
+		span   string
+		attrs  []attribute.KeyValue
+		wantOK bool
+		wantDB string
+	}{
+		{name: "by name", span: "query", wantOK: true, wantDB: "users"},
+		{name: "by name and attribute", span: "query", attrs: []attribute.KeyValue{attribute.String("db", "orders")}, wantOK: true, wantDB: "orders"},
+		{name: "attribute mismatch", span: "query", attrs: []attribute.KeyValue{attribute.String("db", "billing")}},
+		{name: "unknown name", span: "insert"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			span, ok := c.FindSpan(tt.span, tt.attrs...)
+			if ok != tt.wantOK {
+				t.Fatalf("got found %v, want %v", ok, tt.wantOK)
+			}
+			if ok && span.GetAttributes()[0].GetValue().GetStringValue() != tt.wantDB {
+				t.Errorf("found span of db %s, want %s", span.GetAttributes()[0].GetValue().GetStringValue(), tt.wantDB)
+			}
+		})
+	}
+}
+
+// fakeTB records fatal failures instead of stopping the test.
+type fakeTB struct {
+	testing.TB
+	failures []string
+}
+
+func (f *fakeTB) Helper() {}
+
+func (f *fakeTB) Fatalf(format string, args ...any) {
+	f.failures = append(f.failures, fmt.Sprintf(format, args...))
+}
+
+func TestCollectorRequireFailures(t *testing.T) {
+	c := NewBufconnCollector(t)
+
+	tb := &fakeTB{}
+	c.RequireSpan(tb, 20*time.Millisecond, "missing")
+	if len(tb.failures) != 1 {
+		t.Errorf("RequireSpan reported %d failures for a missing span, want 1", len(tb.failures))
+	}
+
+	tb = &fakeTB{}
+	c.RequireAuthorization(tb, "Basic x")
+	if len(tb.failures) != 1 {
+		t.Errorf("RequireAuthorization reported %d failures without requests, want 1", len(tb.failures))
+	}
+
+	c.metadata = append(c.metadata, metadata.Pairs("authorization", "Basic x"), metadata.Pairs("authorization", "Basic y"))
+	tb = &fakeTB{}
+	c.RequireAuthorization(tb, "Basic x")
+	if len(tb.failures) != 1 {
+		t.Errorf("RequireAuthorization reported %d failures for a wrong header, want 1", len(tb.failures))
+	}
+}
+
+func TestHasAttributes(t *testing.T) {
+	attrs := []*commonpb.KeyValue{
+		{Key: "s", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "v"}}},
+		{Key: "b", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: true}}},
+		{Key: "i", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 7}}},
+		{Key: "f", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: 1.5}}},
+		{Key: "l", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: []*commonpb.AnyValue{
+			{Value: &commonpb.AnyValue_StringValue{StringValue: "a"}},
+			{Value: &commonpb.AnyValue_StringValue{StringValue: "b"}},
+		}}}}},
+	}
+
+	tests := []struct {
+		name string
+		want []attribute.KeyValue
+		ok   bool
+	}{
+		{name: "none", ok: true},
+		{name: "all types", want: []attribute.KeyValue{
+			attribute.String("s", "v"), attribute.Bool("b", true), attribute.Int64("i", 7),
+			attribute.Float64("f", 1.5), attribute.StringSlice("l", []string{"a", "b"}),
+		}, ok: true},
+		{name: "different string", want: []attribute.KeyValue{attribute.String("s", "w")}},
+		{name: "different bool", want: []attribute.KeyValue{attribute.Bool("b", false)}},
+		{name: "different int", want: []attribute.KeyValue{attribute.Int64("i", 8)}},
+		{name: "different float", want: []attribute.KeyValue{attribute.Float64("f", 2.5)}},
+		{name: "different list", want: []attribute.KeyValue{attribute.StringSlice("l", []string{"a"})}},
+		{name: "different type", want: []attribute.KeyValue{attribute.Int64("b", 1)}},
+		{name: "missing key", want: []attribute.KeyValue{attribute.String("x", "v")}},
+		{name: "one of several missing", want: []attribute.KeyValue{attribute.String("s", "v"), attribute.String("x", "v")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HasAttributes(attrs, tt.want...); got != tt.ok {
+				t.Errorf("got %v, want %v", got, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package odjtest
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pedramktb/go-odj"
+	"gopkg.in/yaml.v3"
+)
+
+// FixturesOption configures LoadFixtures.
+type FixturesOption func(*fixturesOptions)
+
+type fixturesOptions struct {
+	now   time.Time
+	funcs template.FuncMap
+}
+
+// FixturesWithNow sets the time the "now", "ago" and "fromNow" template functions are relative to,
+// e.g. to get reproducible golden files. Defaults to the time LoadFixtures is called.
+func FixturesWithNow(now time.Time) FixturesOption {
+	return func(o *fixturesOptions) {
+		o.now = now
+	}
+}
+
+// FixturesWithFuncs adds functions to the templates of the fixture files.
+func FixturesWithFuncs(funcs template.FuncMap) FixturesOption {
+	return func(o *fixturesOptions) {
+		for name, fn := range funcs {
+			o.funcs[name] = fn
+		}
+	}
+}
+
+// fixturesNamespace is the namespace of the name based UUIDs generated by the "uuid" template function.
+var fixturesNamespace = uuid.MustParse("6f646a2d-6669-5874-b572-65732d757569")
+
+type fixture struct {
+	table string
+	file  string
+	sql   string
+	rows  []map[string]any
+}
+
+// LoadFixtures loads the fixture files at the root of fsys into the database of pool in one transaction,
+// failing the test on errors. Every file holds the rows of the table it is named after, optionally schema qualified,
+// e.g. "users.yml" or "billing.invoices.json" holds a list of objects mapping columns to values,
+// and "users.sql" holds statements inserting them. Tables are loaded in the order of their foreign keys,
+// so referenced rows exist before the rows referencing them, and sequences of serial and identity columns
+// are advanced past the loaded values afterwards.
+//
+// Files are text/template templates with these functions besides those added with FixturesWithFuncs:
+//
+//	{{now}}              the current time, see FixturesWithNow
+//	{{ago "36h"}}        the time a duration before now
+//	{{fromNow "15m"}}    the time a duration after now
+//	{{uuid "alice"}}     a UUID derived from a name, which is the same in every file, e.g. to reference rows
+//	{{uuid}}             a random UUID
+func LoadFixtures(t testing.TB, pool *pgxpool.Pool, fsys fs.FS, opts ...FixturesOption) {
+	t.Helper()
+	o := fixturesOptions{now: time.Now(), funcs: template.FuncMap{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	fixtures, err := o.read(fsys)
+	if err != nil {
+		t.Fatalf("failed to read fixtures: %v", err)
+	}
+
+	ctx := context.Background()
+	if err := odj.InTx(ctx, pool, odj.TxOptions{MaxAttempts: 1}, func(ctx context.Context, tx pgx.Tx) error {
+		oids, err := fixturesSort(ctx, tx, fixtures)
+		if err != nil {
+			return err
+		}
+		for i, f := range fixtures {
+			if err := f.load(ctx, tx); err != nil {
+				return err
+			}
+			if err := fixturesResetSequences(ctx, tx, oids[i]); err != nil {
+				return fmt.Errorf("failed to reset sequences of %s: %w", f.table, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to load fixtures: %v", err)
+	}
+}
+
+func (o fixturesOptions) read(fsys fs.FS) ([]*fixture, error) {
+	// Postgres stores microseconds, so finer times would not round-trip.
+	now := o.now.UTC().Truncate(time.Microsecond)
+	funcs := template.FuncMap{
+		"now": func() string { return now.Format(time.RFC3339Nano) },
+		"ago": func(d string) (string, error) {
+			dur, err := time.ParseDuration(d)
+			return now.Add(-dur).Format(time.RFC3339Nano), err
+		},
+		"fromNow": func(d string) (string, error) {
+			dur, err := time.ParseDuration(d)
+			return now.Add(dur).Format(time.RFC3339Nano), err
+		},
+		"uuid": func(name ...string) string {
+			if len(name) == 0 {
+				return uuid.NewString()
+			}
+			return uuid.NewSHA1(fixturesNamespace, []byte(strings.Join(name, "/"))).String()
+		},
+	}
+	for name, fn := range o.funcs {
+		funcs[name] = fn
+	}
+
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []*fixture
+	tables := make(map[string]string)
+	for _, entry := range entries {
+		ext := path.Ext(entry.Name())
+		if entry.IsDir() || !slices.Contains([]string{".yml", ".yaml", ".json", ".sql"}, ext) {
+			continue
+		}
+		f := &fixture{table: strings.TrimSuffix(entry.Name(), ext), file: entry.Name()}
+		if other, ok := tables[f.table]; ok {
+			return nil, fmt.Errorf("fixtures %s and %s are for the same table", other, f.file)
+		}
+		tables[f.table] = f.file
+
+		content, err := fs.ReadFile(fsys, f.file)
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(f.file).Funcs(funcs).Option("missingkey=error").Parse(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse fixture %s: %w", f.file, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, nil); err != nil {
+			return nil, fmt.Errorf("failed to execute fixture %s: %w", f.file, err)
+		}
+
+		switch ext {
+		case ".sql":
+			f.sql = buf.String()
+		case ".json":
+			dec := json.NewDecoder(&buf)
+			dec.UseNumber()
+			err = dec.Decode(&f.rows)
+		default:
+			err = yaml.Unmarshal(buf.Bytes(), &f.rows)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode fixture %s: %w", f.file, err)
+		}
+		fixtures = append(fixtures, f)
+	}
+	return fixtures, nil
+}
+
+// fixturesSort sorts fixtures so that tables come after the tables they reference and returns their OIDs.
+func fixturesSort(ctx context.Context, tx pgx.Tx, fixtures []*fixture) ([]uint32, error) {
+	oid := make(map[*fixture]uint32, len(fixtures))
+	byOID := make(map[uint32]*fixture, len(fixtures))
+	for _, f := range fixtures {
+		var id uint32
+		if err := tx.QueryRow(ctx, "SELECT $1::regclass::oid", f.table).Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to look up table of fixture %s: %w", f.file, err)
+		}
+		oid[f], byOID[id] = id, f
+	}
+
+	rows, err := tx.Query(ctx, `SELECT DISTINCT conrelid, confrelid FROM pg_constraint
+WHERE contype = 'f' AND conrelid <> confrelid AND conrelid = ANY($1) AND confrelid = ANY($1)`, slices.Collect(maps.Keys(byOID)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up foreign keys: %w", err)
+	}
+	deps := make(map[*fixture][]*fixture)
+	var from, to uint32
+	if _, err := pgx.ForEachRow(rows, []any{&from, &to}, func() error {
+		deps[byOID[from]] = append(deps[byOID[from]], byOID[to])
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to look up foreign keys: %w", err)
+	}
+
+	slices.SortFunc(fixtures, func(a, b *fixture) int { return cmp.Compare(a.table, b.table) })
+	sorted := make([]*fixture, 0, len(fixtures))
+	state := make(map[*fixture]int) // 1 while visiting, 2 once sorted
+	var visit func(f *fixture, path []string) error
+	visit = func(f *fixture, path []string) error {
+		switch state[f] {
+		case 1:
+			return fmt.Errorf("fixtures have a foreign key cycle: %s -> %s", strings.Join(path, " -> "), f.table)
+		case 2:
+			return nil
+		}
+		state[f] = 1
+		for _, dep := range deps[f] {
+			if err := visit(dep, append(path, f.table)); err != nil {
+				return err
+			}
+		}
+		state[f] = 2
+		sorted = append(sorted, f)
+		return nil
+	}
+	for _, f := range fixtures {
+		if err := visit(f, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	copy(fixtures, sorted)
+	oids := make([]uint32, len(fixtures))
+	for i, f := range fixtures {
+		oids[i] = oid[f]
+	}
+	return oids, nil
+}
+
+func (f *fixture) load(ctx context.Context, tx pgx.Tx) error {
+	if f.sql != "" {
+		if _, err := tx.Exec(ctx, f.sql); err != nil {
+			return fmt.Errorf("failed to load fixture %s: %w", f.file, err)
+		}
+		return nil
+	}
+
+	table := pgx.Identifier(strings.Split(f.table, ".")).Sanitize()
+	for i, row := range f.rows {
+		columns := slices.Sorted(maps.Keys(row))
+		names := make([]string, len(columns))
+		params := make([]string, len(columns))
+		args := make([]any, len(columns))
+		for j, column := range columns {
+			names[j] = pgx.Identifier{column}.Sanitize()
+			params[j] = "$" + strconv.Itoa(j+1)
+			arg, err := fixturesValue(row[column])
+			if err != nil {
+				return fmt.Errorf("invalid value of column %s in row %d of fixture %s: %w", column, i+1, f.file, err)
+			}
+			args[j] = arg
+		}
+		query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(names, ", "), strings.Join(params, ", "))
+		if len(columns) == 0 {
+			query = fmt.Sprintf("INSERT INTO %s DEFAULT VALUES", table)
+		}
+		if _, err := tx.Exec(ctx, query, args...); err != nil {
+			return fmt.Errorf("failed to insert row %d of fixture %s: %w", i+1, f.file, err)
+		}
+	}
+	return nil
+}
+
+// fixturesValue converts a decoded value to its text representation, which Postgres casts to the column's type.
+// Objects and lists become JSON, e.g. for json and jsonb columns.
+func fixturesValue(v any) (any, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return v, nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case map[string]any, []any:
+		b, err := json.Marshal(v)
+		return string(b), err
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// fixturesResetSequences advances the sequences of the serial and identity columns of a table past its largest
+// values, so that rows inserted by the test do not collide with the fixtures.
+func fixturesResetSequences(ctx context.Context, tx pgx.Tx, table uint32) error {
+	rows, err := tx.Query(ctx, `SELECT attrelid::regclass::text, quote_ident(attname), pg_get_serial_sequence(attrelid::regclass::text, attname)
+FROM pg_attribute WHERE attrelid = $1 AND attnum > 0 AND NOT attisdropped
+	AND pg_get_serial_sequence(attrelid::regclass::text, attname) IS NOT NULL`, table)
+	if err != nil {
+		return err
+	}
+	var queries []string
+	var name, column, sequence string
+	if _, err := pgx.ForEachRow(rows, []any{&name, &column, &sequence}, func() error {
+		queries = append(queries, fmt.Sprintf("SELECT setval(%s, max(%s)) FROM %s HAVING max(%s) IS NOT NULL",
+			quoteLiteral(sequence), column, name, column))
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(ctx, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,75 @@
+package odjtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var updateGolden = flag.Bool("odjtest.update", false, "rewrite the golden files of AssertTableGolden instead of comparing them")
+
+// GoldenOption configures AssertTableGolden.
+type GoldenOption func(*goldenOptions)
+
+type goldenOptions struct {
+	ignore []string
+}
+
+// GoldenIgnoreColumns leaves columns out of the comparison whose values differ between runs,
+// e.g. generated IDs or timestamps set by the database.
+func GoldenIgnoreColumns(columns ...string) GoldenOption {
+	return func(o *goldenOptions) {
+		o.ignore = append(o.ignore, columns...)
+	}
+}
+
+// AssertTableGolden compares the contents of table, optionally schema qualified, with the golden file at path,
+// e.g. "testdata/users.golden.json", and fails the test if they differ. Rows are written as indented JSON objects
+// sorted by their contents, so the golden file does not depend on the physical order of the rows.
+// Running the tests with -odjtest.update writes the golden files instead, creating their directories if needed.
+func AssertTableGolden(t testing.TB, pool *pgxpool.Pool, table, path string, opts ...GoldenOption) {
+	t.Helper()
+	o := goldenOptions{ignore: []string{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var raw []byte
+	if err := pool.QueryRow(context.Background(), `SELECT coalesce(jsonb_agg(r ORDER BY r::text), '[]')
+FROM (SELECT to_jsonb(t) - $1::text[] AS r FROM `+pgx.Identifier(strings.Split(table, ".")).Sanitize()+` t) rows`,
+		o.ignore).Scan(&raw); err != nil {
+		t.Fatalf("failed to read table %s: %v", table, err)
+	}
+	var got bytes.Buffer
+	if err := json.Indent(&got, raw, "", "  "); err != nil {
+		t.Fatalf("failed to format table %s: %v", table, err)
+	}
+	got.WriteByte('\n')
+
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("failed to create directory of golden file %s: %v", path, err)
+		}
+		if err := os.WriteFile(path, got.Bytes(), 0o644); err != nil {
+			t.Fatalf("failed to write golden file %s: %v", path, err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file %s, run the tests with -odjtest.update to create it: %v", path, err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("table %s does not match golden file %s, run the tests with -odjtest.update to update it\ngot:\n%s\nwant:\n%s",
+			table, path, got.Bytes(), want)
+	}
+}
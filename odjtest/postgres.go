@@ -0,0 +1,97 @@
+package odjtest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pedramktb/go-odj"
+	"github.com/pedramktb/go-typx"
+	"github.com/testcontainers/testcontainers-go"
+)
+
+var (
+	postgresContainer testcontainers.Container
+	// postgresSkipReason is set when no container could be started because Docker is unavailable.
+	postgresSkipReason string
+)
+
+// RunWithPostgres runs the tests of a package with one Postgres test container shared by all of them,
+// which tests get from PostgresContainer or SetupPostgresDB. Call it from TestMain:
+//
+//	func TestMain(m *testing.M) {
+//		os.Exit(odjtest.RunWithPostgres(m))
+//	}
+//
+// After the tests ran, databases created by them and never dropped are reported, and the container is terminated,
+// unless it is reused with odj.PostgresContainerWithReuse. If Docker is unavailable, the tests still run, but those
+// using the container are skipped.
+func RunWithPostgres(m *testing.M, opts ...odj.PostgresContainerOption) int {
+	ctx := context.Background()
+
+	if err := dockerHealth(ctx); err != nil {
+		postgresSkipReason = fmt.Sprintf("Docker is unavailable, skipping tests that need a Postgres test container: %v", err)
+		fmt.Fprintln(os.Stderr, "odjtest:", postgresSkipReason)
+		return m.Run()
+	}
+
+	container, terminate, err := odj.RunPostgresTestContainer(ctx, opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "odjtest:", err)
+		return 1
+	}
+	defer func() {
+		if err := terminate(); err != nil {
+			fmt.Fprintln(os.Stderr, "odjtest: failed to terminate postgres test container:", err)
+		}
+	}()
+	postgresContainer = container
+
+	code := m.Run()
+
+	if leaked, err := odj.PostgresTestContainerLeakedDBs(ctx, postgresContainer); err != nil {
+		fmt.Fprintln(os.Stderr, "odjtest: failed to check for leaked test databases:", err)
+	} else if len(leaked) > 0 {
+		fmt.Fprintf(os.Stderr, "odjtest: %d test databases were not dropped: %s\n", len(leaked), strings.Join(leaked, ", "))
+	}
+	return code
+}
+
+// PostgresContainer returns the container started by RunWithPostgres. It skips the test if Docker is unavailable
+// and fails it if RunWithPostgres was not used.
+func PostgresContainer(tb testing.TB) testcontainers.Container {
+	tb.Helper()
+	if postgresSkipReason != "" {
+		tb.Skip(postgresSkipReason)
+	}
+	if postgresContainer == nil {
+		tb.Fatal("no postgres test container, call odjtest.RunWithPostgres from TestMain")
+	}
+	return postgresContainer
+}
+
+// SetupPostgresDB creates a database for the test in the container started by RunWithPostgres
+// with odj.PostgresTestContainerSetupDB, which drops it when the test finishes.
+func SetupPostgresDB(t *testing.T, opts ...typx.KV[string, string]) *pgxpool.Pool {
+	t.Helper()
+	// t.Context is cancelled before the cleanup dropping the database runs.
+	return odj.PostgresTestContainerSetupDB(context.Background(), t, PostgresContainer(t), opts...)
+}
+
+func dockerHealth(ctx context.Context) (err error) {
+	// The provider panics instead of returning an error in some environments without Docker.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	provider, err := testcontainers.ProviderDocker.GetProvider()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = provider.Close() }()
+	return provider.Health(ctx)
+}
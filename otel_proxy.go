@@ -3,35 +3,78 @@ package odj
 import (
 	"context"
 	"encoding/base64"
-	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/gogo/protobuf/proto"
-	"go.opentelemetry.io/otel/attribute"
-	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"github.com/pedramktb/go-ctxslog"
+	"go.opentelemetry.io/otel/metric"
 	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
 	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 )
 
-type otelProxy struct {
+// OtelProxy is an http.Handler that forwards OTLP/HTTP trace exports to an OTel gRPC collector.
+// It is created by NewOtelTraceProxy and shut down with Shutdown to flush any buffered spans, which happens
+// automatically at shutdown if the context given with OtelProxyWithContext derives from the one returned by Bootstrap.
+type OtelProxy struct {
 	*http.ServeMux
-	traceClient coltracepb.TraceServiceClient
-	attributes  []*commonpb.KeyValue
+	ctx             context.Context
+	routes          []*otelProxyRoute
+	upstreams       map[string]*otelProxyUpstream
+	processors      []OtelProxyProcessor
+	retry           otelProxyRetry
+	syncRetryBudget time.Duration
+	buffer          *otelProxyBufferConfig
+	spillDir        string
+	spillLimit      int64
+	meterProvider   metric.MeterProvider
+	telemetry       *otelProxyTelemetry
+	debugSampleRate float64
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+}
+
+// OtelProxyOption configures optional behavior of the proxy created by NewOtelTraceProxy.
+type OtelProxyOption func(*OtelProxy)
+
+// OtelProxyWithContext sets the context providing the logger for work that is not tied to a request,
+// such as background exports. Its cancellation is ignored. Defaults to context.Background().
+func OtelProxyWithContext(ctx context.Context) OtelProxyOption {
+	return func(p *OtelProxy) {
+		p.ctx = context.WithoutCancel(ctx)
+	}
 }
 
 // NewOtelTraceProxy creates a new OpenTelemetry proxy handler that forwards OTLP/HTTP protobuf requests
 // to a configured OTel gRPC collector. This is because ODJ/StackIT did not feel like implementing/allowing OTLP/HTTP.
-func NewOtelTraceProxy(srcComponent, endpoint, user, pass string) (http.Handler, error) {
+//
+// By default every request is exported synchronously and collector errors are answered right away,
+// with retryable ones mapped to HTTP codes that OTLP clients retry. See OtelProxyWithSyncRetry.
+// Use OtelProxyWithBuffer to batch spans across requests in the background instead.
+//
+// Requests not matching any route added with OtelProxyWithRoutes are attributed to srcComponent and sent to endpoint.
+// srcComponent may be empty if routes are given, in which case unmatched requests are refused.
+func NewOtelTraceProxy(srcComponent, endpoint, user, pass string, opts ...OtelProxyOption) (*OtelProxy, error) {
 	if endpoint == "" {
 		return nil, errors.New("otel trace endpoint is required")
 	}
@@ -42,144 +85,323 @@ func NewOtelTraceProxy(srcComponent, endpoint, user, pass string) (http.Handler,
 		return nil, errors.New("otel trace password is required")
 	}
 
-	var opts []grpc.DialOption
+	p := &OtelProxy{
+		ctx:        context.Background(),
+		upstreams:  make(map[string]*otelProxyUpstream),
+		retry:      defaultOtelProxyRetry,
+		spillLimit: defaultOtelProxySpillLimit,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	var err error
+	if p.telemetry, err = newOtelProxyTelemetry(p.meterProvider); err != nil {
+		return nil, fmt.Errorf("failed to create otel proxy metrics: %w", err)
+	}
+
+	if srcComponent != "" {
+		p.routes = append(p.routes, &otelProxyRoute{OtelProxyRoute: OtelProxyRoute{SrcComponent: srcComponent}})
+	} else if len(p.routes) == 0 {
+		return nil, errors.New("otel proxy source component is required")
+	}
+
+	if err := p.connectRoutes(endpoint, user, pass); err != nil {
+		for _, u := range p.upstreams {
+			_ = u.conn.Close()
+		}
+		return nil, err
+	}
+
+	p.ServeMux = http.NewServeMux()
+	p.HandleFunc("/v1/traces", p.traces)
+	for _, prefix := range p.pathPrefixes() {
+		p.HandleFunc(prefix+"/v1/traces", p.traces)
+	}
+	// You can implement /v1/metrics, /v1/logs, etc. if needed (though even the gRPC collector does not support them yet)
+
+	for _, u := range p.upstreams {
+		if u.buffer != nil {
+			u.buffer.start()
+		}
+	}
+	onShutdown(p.ctx, p.Shutdown)
+	return p, nil
+}
+
+// connectRoutes validates the routes and connects each of them to its upstream.
+func (p *OtelProxy) connectRoutes(endpoint, user, pass string) error {
+	defaultUpstream, err := p.upstream(endpoint, user, pass)
+	if err != nil {
+		return err
+	}
+	for _, route := range p.routes {
+		if err := otelProxyValidateRoute(route.OtelProxyRoute); err != nil {
+			return err
+		}
+		if route.Endpoint == "" {
+			route.upstream = defaultUpstream
+		} else if route.upstream, err = p.upstream(route.Endpoint, route.User, route.Pass); err != nil {
+			return err
+		}
+		route.attributes = otelProxyRouteAttributes(route.OtelProxyRoute)
+	}
+	return nil
+}
+
+// otelProxyUpstream is a connection to one gRPC collector, together with its buffer and spill directory.
+type otelProxyUpstream struct {
+	p        *OtelProxy
+	endpoint string
+	conn     *grpc.ClientConn
+	client   coltracepb.TraceServiceClient
+	buffer   *otelProxyBuffer
+	spillDir string
+	spillMu  sync.Mutex
+}
+
+// upstream returns the upstream for the given collector and credentials, connecting to it on first use.
+// The first upstream spills into the spill directory itself, further upstreams into a subdirectory each.
+func (p *OtelProxy) upstream(endpoint, user, pass string) (*otelProxyUpstream, error) {
+	key := endpoint + "\x00" + user + "\x00" + pass
+	if u, ok := p.upstreams[key]; ok {
+		return u, nil
+	}
+
+	var dialOpts []grpc.DialOption
 	if Stage == StageLocal {
-		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	} else {
-		opts = append(opts, grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, "")))
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, "")))
 	}
-	opts = append(opts, grpc.WithPerRPCCredentials(
+	dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(
 		&otelAuth{"Basic " + base64.StdEncoding.EncodeToString(fmt.Appendf(nil, "%s:%s", user, pass))},
 	))
 
-	conn, err := grpc.NewClient(endpoint, opts...)
+	conn, err := grpc.NewClient(endpoint, dialOpts...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to gRPC collector: %w", err)
-	}
-
-	client := coltracepb.NewTraceServiceClient(conn)
-	attributes := []attribute.KeyValue{
-		attribute.String("otel_proxy.service.name", Component),
-		attribute.String("otel_proxy.service.version", FullVersion),
-		attribute.String("otel_proxy.deployment.environment", Stage.String()),
-		semconv.ServiceNameKey.String(srcComponent),
-		semconv.DeploymentEnvironmentNameKey.String(Stage.String()),
-	}
-	p := &otelProxy{
-		traceClient: client,
-		attributes:  make([]*commonpb.KeyValue, 0, len(attributes)),
-	}
-	for _, attr := range attributes {
-		kv := &commonpb.KeyValue{
-			Key: string(attr.Key),
-			Value: &commonpb.AnyValue{
-				Value: &commonpb.AnyValue_StringValue{
-					StringValue: attr.Value.AsString(),
-				},
-			},
+		return nil, fmt.Errorf("failed to connect to gRPC collector %s: %w", endpoint, err)
+	}
+
+	u := &otelProxyUpstream{
+		p:        p,
+		endpoint: endpoint,
+		conn:     conn,
+		client:   &otelProxyInstrumentedClient{coltracepb.NewTraceServiceClient(conn), p.telemetry},
+	}
+	if p.spillDir != "" {
+		u.spillDir = p.spillDir
+		if len(p.upstreams) > 0 {
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(key))
+			u.spillDir = filepath.Join(p.spillDir, fmt.Sprintf("upstream-%016x", h.Sum64()))
+		}
+		if err := os.MkdirAll(u.spillDir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create otel proxy spill directory: %w", err)
 		}
-		p.attributes = append(p.attributes, kv)
 	}
-	p.ServeMux = http.NewServeMux()
-	p.HandleFunc("/v1/traces", p.traces)
-	// You can implement /v1/metrics, /v1/logs, etc. if needed (though even the gRPC collector does not support them yet)
-	return p, nil
+	if p.buffer != nil {
+		u.buffer = &otelProxyBuffer{otelProxyBufferConfig: *p.buffer, u: u}
+	}
+	p.upstreams[key] = u
+	return u, nil
 }
 
-func (p *otelProxy) traces(w http.ResponseWriter, r *http.Request) {
+func (p *OtelProxy) traces(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := ctxslog.FromContext(ctx)
+	contentType := r.Header.Get("Content-Type")
+
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		w.Header().Set("Allow", http.MethodPost)
+		p.writeStatus(w, r, http.StatusMethodNotAllowed, status.New(codes.Unimplemented, "method not allowed"), 0)
+		return
+	}
+
+	route := p.route(r)
+	if route == nil {
+		logger.WarnContext(ctx, "no otel proxy route matches the request", slog.String("path", r.URL.Path))
+		p.writeStatus(w, r, http.StatusForbidden, status.New(codes.PermissionDenied, "no route matches the request"), 0)
 		return
 	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		logger.WarnContext(ctx, "failed to read otel proxy request body", slog.Any("err", err))
+		p.writeStatus(w, r, http.StatusBadRequest, status.New(codes.InvalidArgument, "error reading request body"), 0)
 		return
 	}
 	if err := r.Body.Close(); err != nil {
-		log.Printf("Error closing request body: %v", err)
+		logger.WarnContext(ctx, "failed to close otel proxy request body", slog.Any("err", err))
 	}
 
+	p.telemetry.payloadSize.Record(ctx, int64(len(body)))
+
 	var req coltracepb.ExportTraceServiceRequest
-	contentType := r.Header.Get("Content-Type")
 
 	switch {
 	case strings.HasPrefix(contentType, "application/json"):
-		var genericPayload map[string]any
-		if err := json.Unmarshal(body, &genericPayload); err != nil {
-			log.Printf("Error unmarshaling JSON into generic map: %v", err)
-			http.Error(w, "Bad request body", http.StatusBadRequest)
-			return
-		}
-
-		// Recursively find and convert hex IDs to Base64.
-		transformHexIdsToBase64(genericPayload)
-
-		// Marshal the corrected structure back to JSON bytes.
-		correctedBody, err := json.Marshal(genericPayload)
-		if err != nil {
-			log.Printf("Error re-marshaling corrected JSON: %v", err)
-			http.Error(w, "Internal server error during conversion", http.StatusInternalServerError)
-			return
-		}
-
-		if err := protojson.Unmarshal(correctedBody, &req); err != nil {
-			log.Printf("Error unmarshaling JSON: %v", err)
-			http.Error(w, "Bad request body", http.StatusBadRequest)
+		if err := unmarshalOTLPJSON(body, &req); err != nil {
+			logger.WarnContext(ctx, "failed to unmarshal otel proxy JSON request", slog.Any("err", err))
+			p.writeStatus(w, r, http.StatusBadRequest, status.Newf(codes.InvalidArgument, "bad request body: %v", err), 0)
 			return
 		}
 	case strings.HasPrefix(contentType, "application/x-protobuf"):
 		if err := proto.Unmarshal(body, &req); err != nil {
-			log.Printf("Error unmarshaling protobuf: %v", err)
-			http.Error(w, "Bad request body", http.StatusBadRequest)
+			logger.WarnContext(ctx, "failed to unmarshal otel proxy protobuf request", slog.Any("err", err))
+			p.writeStatus(w, r, http.StatusBadRequest, status.Newf(codes.InvalidArgument, "bad request body: %v", err), 0)
 			return
 		}
 	default:
-		log.Printf("Unsupported Content-Type: %s", contentType)
-		http.Error(w, "Unsupported Content-Type", http.StatusUnsupportedMediaType)
+		logger.WarnContext(ctx, "unsupported otel proxy request content type", slog.String("content_type", contentType))
+		p.writeStatus(w, r, http.StatusUnsupportedMediaType, status.Newf(codes.InvalidArgument, "unsupported content type %q", contentType), 0)
 		return
 	}
 
-	// Enforce resource attributes
-	p.overrideResourceAttributes(&req)
+	// Scrub the payload before enforcing resource attributes, so processors cannot touch the enforced ones.
+	p.process(req.GetResourceSpans())
+	route.overrideResourceAttributes(&req)
+
+	spans := otelProxyCountRequestSpans(&req)
+	p.telemetry.accepted.Add(ctx, spans)
+	p.logPayloadSummary(ctx, contentType, len(body), &req)
+
+	if route.upstream.buffer != nil {
+		rejected := route.upstream.buffer.enqueue(ctx, req.GetResourceSpans())
+		p.telemetry.reject(ctx, rejected, otelProxyRejectBufferFull)
+		if rejected > 0 && rejected == spans {
+			// Nothing was accepted, ask the client to come back once the queue had a chance to drain.
+			logger.WarnContext(ctx, "otel proxy buffer is full, rejected all spans", slog.Int64("rejected", rejected))
+			p.writeStatus(w, r, http.StatusServiceUnavailable, status.New(codes.Unavailable, "proxy buffer is full"), p.buffer.batchTimeout)
+			return
+		}
+		resp := &coltracepb.ExportTraceServiceResponse{}
+		if rejected > 0 {
+			logger.WarnContext(ctx, "otel proxy buffer is full, rejected some spans", slog.Int64("rejected", rejected))
+			resp.PartialSuccess = &coltracepb.ExportTracePartialSuccess{
+				RejectedSpans: rejected,
+				ErrorMessage:  "proxy buffer is full",
+			}
+		}
+		p.writeMessage(w, r, http.StatusOK, resp)
+		return
+	}
 
-	log.Printf("Forwarding %d resource spans to gRPC collector (from %s)", len(req.GetResourceSpans()), contentType)
-	resp, err := p.traceClient.Export(r.Context(), &req)
+	logger.DebugContext(ctx, "forwarding spans to gRPC collector", slog.Int64("spans", spans), slog.String("content_type", contentType))
+	retry := p.retry
+	retry.maxElapsedTime = p.syncRetryBudget
+	resp, err := retry.export(ctx, route.upstream.client, &req)
 	if err != nil {
-		log.Printf("Error exporting traces to gRPC collector: %v", err)
-		// Return a generic server error to the client. The specific error is logged.
-		http.Error(w, "Failed to forward traces", http.StatusInternalServerError)
+		logger.ErrorContext(ctx, "failed to export spans to gRPC collector", slog.Any("err", err))
+		p.telemetry.reject(ctx, spans, otelProxyRejectUpstream)
+		st := status.Convert(err)
+		httpCode, retryAfter := otelProxyHTTPStatus(st)
+		p.writeStatus(w, r, httpCode, st, retryAfter)
 		return
 	}
 
-	// The gRPC collector returns an ExportTraceServiceResponse.
-	// We must marshal this response back into the original content type.
+	// The collector's response, including any partial success, is passed back unchanged.
+	p.writeMessage(w, r, http.StatusOK, resp)
+}
+
+// writeStatus writes st as a google.rpc.Status body, as OTLP/HTTP requires for failed requests.
+// Details are not forwarded, only the code and message. A positive retryAfter is sent as Retry-After header.
+func (p *OtelProxy) writeStatus(w http.ResponseWriter, r *http.Request, httpCode int, st *status.Status, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	p.writeMessage(w, r, httpCode, &spb.Status{
+		Code:    int32(st.Code()),
+		Message: st.Message(),
+	})
+}
+
+// writeMessage marshals msg into the content type of the original request. Requests with an unsupported content type
+// are answered in protobuf, the default OTLP encoding.
+func (p *OtelProxy) writeMessage(w http.ResponseWriter, r *http.Request, httpCode int, msg proto.Message) {
+	contentType := r.Header.Get("Content-Type")
 	var respBody []byte
 	var respContentType string
+	var err error
 
-	switch {
-	case strings.HasPrefix(contentType, "application/json"):
-		respBody, err = protojson.Marshal(resp)
+	if strings.HasPrefix(contentType, "application/json") {
+		respBody, err = protojson.Marshal(msg)
 		respContentType = "application/json"
-	case strings.HasPrefix(contentType, "application/x-protobuf"):
-		respBody, err = proto.Marshal(resp)
+	} else {
+		respBody, err = proto.Marshal(msg)
 		respContentType = "application/x-protobuf"
 	}
 
 	if err != nil {
-		log.Printf("Error marshaling gRPC response: %v", err)
+		ctxslog.FromContext(r.Context()).ErrorContext(r.Context(), "failed to marshal otel proxy response", slog.Any("err", err))
 		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
 		return
 	}
 
 	// Set the correct content type and write the response.
 	w.Header().Set("Content-Type", respContentType)
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(httpCode)
 	if _, err := w.Write(respBody); err != nil {
-		log.Printf("Error writing response: %v", err)
+		ctxslog.FromContext(r.Context()).WarnContext(r.Context(), "failed to write otel proxy response", slog.Any("err", err))
+	}
+}
+
+// otelProxyHTTPStatus maps a collector gRPC status to the OTLP/HTTP status code the client should see.
+// Retryable gRPC codes become 429, 503 or 504, which OTLP/HTTP clients retry; everything else becomes a
+// non-retryable 4xx or 5xx. The returned duration is the server's RetryInfo delay, if any.
+func otelProxyHTTPStatus(st *status.Status) (int, time.Duration) {
+	retryAfter := otelProxyRetryInfo(st)
+	switch st.Code() {
+	case codes.ResourceExhausted:
+		if retryAfter > 0 {
+			return http.StatusTooManyRequests, retryAfter
+		}
+		return http.StatusInternalServerError, 0
+	case codes.Canceled,
+		codes.Aborted,
+		codes.OutOfRange,
+		codes.Unavailable,
+		codes.DataLoss:
+		return http.StatusServiceUnavailable, retryAfter
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout, retryAfter
+	case codes.InvalidArgument,
+		codes.FailedPrecondition:
+		return http.StatusBadRequest, 0
+	case codes.Unimplemented:
+		return http.StatusNotImplemented, 0
+	default:
+		// Includes Unauthenticated and PermissionDenied, which mean the proxy itself is misconfigured.
+		return http.StatusInternalServerError, 0
+	}
+}
+
+// Shutdown stops accepting buffered spans, flushes whatever is still queued to the collectors
+// (or to the spill directory if a collector cannot be reached before ctx is done) and closes the gRPC connections.
+// Calls after the first return the first call's error.
+func (p *OtelProxy) Shutdown(ctx context.Context) error {
+	p.shutdownOnce.Do(func() {
+		p.shutdownErr = p.shutdown(ctx)
+	})
+	return p.shutdownErr
+}
+
+func (p *OtelProxy) shutdown(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, u := range p.upstreams {
+		if u.buffer != nil {
+			wg.Go(func() { u.buffer.stop(ctx) })
+		}
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, u := range p.upstreams {
+		if err := u.conn.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close connection to gRPC collector %s: %w", u.endpoint, err))
+		}
 	}
+	return errors.Join(errs...)
 }
 
 type otelAuth struct {
@@ -196,39 +418,12 @@ func (a *otelAuth) RequireTransportSecurity() bool {
 	return false
 }
 
-func transformHexIdsToBase64(data any) {
-	switch v := data.(type) {
-	case map[string]any:
-		for key, val := range v {
-			// Check for traceId (32 hex chars = 16 bytes) and spanId (16 hex chars = 8 bytes)
-			if key == "traceId" || key == "spanId" || key == "parentSpanId" {
-				if idStr, ok := val.(string); ok {
-					// Attempt to decode from hex
-					decoded, err := hex.DecodeString(idStr)
-					if err == nil {
-						// If successful, re-encode as Base64 and replace the value
-						v[key] = base64.StdEncoding.EncodeToString(decoded)
-					}
-				}
-			} else {
-				// Recurse for other keys
-				transformHexIdsToBase64(val)
-			}
-		}
-	case []any:
-		// If it's a slice, iterate and recurse
-		for _, item := range v {
-			transformHexIdsToBase64(item)
-		}
-	}
-}
-
-func (p *otelProxy) overrideResourceAttributes(req *coltracepb.ExportTraceServiceRequest) {
+func (r *otelProxyRoute) overrideResourceAttributes(req *coltracepb.ExportTraceServiceRequest) {
 	for _, rs := range req.ResourceSpans {
 		if rs.Resource == nil {
-			continue
+			rs.Resource = &resourcepb.Resource{}
 		}
-		rs.Resource.Attributes = upsertAttribute(rs.Resource.Attributes, p.attributes...)
+		rs.Resource.Attributes = upsertAttribute(rs.Resource.Attributes, r.attributes...)
 	}
 }
 
@@ -0,0 +1,466 @@
+package odj
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pedramktb/go-ctxslog"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// OtelProxyWithBuffer makes the proxy accept spans into a bounded in-memory queue and export them to the collector
+// in the background, batching spans across requests. queueSize is the maximum number of spans held in memory,
+// maxBatchSize the maximum number of spans sent in one export and batchTimeout the maximum time a span waits in the queue.
+// Requests are answered with 200 as soon as their spans are queued; spans that do not fit are reported as rejected
+// via partial success, unless a spill directory is configured with OtelProxyWithSpillDir.
+func OtelProxyWithBuffer(queueSize, maxBatchSize int, batchTimeout time.Duration) OtelProxyOption {
+	return func(p *OtelProxy) {
+		if queueSize <= 0 {
+			queueSize = 8192
+		}
+		if maxBatchSize <= 0 || maxBatchSize > queueSize {
+			maxBatchSize = min(512, queueSize)
+		}
+		if batchTimeout <= 0 {
+			batchTimeout = 5 * time.Second
+		}
+		p.buffer = &otelProxyBufferConfig{
+			queueSize:    int64(queueSize),
+			maxBatchSize: int64(maxBatchSize),
+			batchTimeout: batchTimeout,
+		}
+	}
+}
+
+// OtelProxyWithRetry configures the exponential backoff used when the collector answers with a retryable gRPC code
+// to a background export of a buffered proxy. A RetryInfo detail returned by the collector takes precedence over
+// the computed backoff. A maxElapsedTime of zero disables retries.
+func OtelProxyWithRetry(initialInterval, maxInterval, maxElapsedTime time.Duration) OtelProxyOption {
+	return func(p *OtelProxy) {
+		p.retry = otelProxyRetry{
+			initialInterval: max(initialInterval, time.Millisecond),
+			maxInterval:     max(maxInterval, initialInterval),
+			maxElapsedTime:  maxElapsedTime,
+		}
+	}
+}
+
+// OtelProxyWithSyncRetry makes an unbuffered proxy retry retryable collector errors with the backoff of
+// OtelProxyWithRetry for up to budget before answering the request. By default it answers right away with a
+// retryable HTTP status and leaves retrying to the client, because browser exporters time out quickly and resend
+// the request themselves, duplicating the spans of a slow retry. Keep budget well below the clients' timeout.
+func OtelProxyWithSyncRetry(budget time.Duration) OtelProxyOption {
+	return func(p *OtelProxy) {
+		p.syncRetryBudget = max(budget, 0)
+	}
+}
+
+// OtelProxyWithSpillDir makes a buffered proxy write batches it cannot hold in memory or deliver to the collector
+// into dir, and re-send them once the collector is reachable again, including after a restart.
+// The batches of each collector are limited in size, see OtelProxyWithSpillLimit.
+// It has no effect without OtelProxyWithBuffer.
+func OtelProxyWithSpillDir(dir string) OtelProxyOption {
+	return func(p *OtelProxy) {
+		p.spillDir = dir
+	}
+}
+
+// OtelProxyWithSpillLimit limits the total size of the batches spilled for each collector to maxBytes,
+// so that a long collector outage cannot fill the disk. Once the limit is reached, the oldest batches are dropped
+// to make room for new ones. Defaults to 256 MiB.
+func OtelProxyWithSpillLimit(maxBytes int64) OtelProxyOption {
+	return func(p *OtelProxy) {
+		if maxBytes > 0 {
+			p.spillLimit = maxBytes
+		}
+	}
+}
+
+const defaultOtelProxySpillLimit = 256 << 20
+
+type otelProxyRetry struct {
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	maxElapsedTime  time.Duration
+}
+
+var defaultOtelProxyRetry = otelProxyRetry{
+	initialInterval: time.Second,
+	maxInterval:     30 * time.Second,
+	maxElapsedTime:  time.Minute,
+}
+
+// export sends req to the collector, retrying retryable failures until maxElapsedTime has passed or ctx is done.
+func (r otelProxyRetry) export(ctx context.Context, client coltracepb.TraceServiceClient, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	deadline := time.Now().Add(r.maxElapsedTime)
+	backoff := r.initialInterval
+	for {
+		resp, err := client.Export(ctx, req)
+		if err == nil {
+			return resp, nil
+		}
+		delay, ok := otelProxyRetryDelay(err, backoff)
+		if !ok || time.Now().Add(delay).After(deadline) {
+			return nil, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, r.maxInterval)
+	}
+}
+
+// otelProxyRetryDelay reports whether err is retryable according to the OTLP specification and how long to wait before retrying.
+func otelProxyRetryDelay(err error, backoff time.Duration) (time.Duration, bool) {
+	st := status.Convert(err)
+	throttle := otelProxyRetryInfo(st)
+
+	switch st.Code() {
+	case codes.Canceled,
+		codes.DeadlineExceeded,
+		codes.Aborted,
+		codes.OutOfRange,
+		codes.Unavailable,
+		codes.DataLoss:
+	case codes.ResourceExhausted:
+		// Only retryable if the server tells us when to come back.
+		if throttle == 0 {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	if throttle > 0 {
+		return throttle, true
+	}
+	// Add up to ±20% jitter so that many proxies do not retry in lockstep.
+	jitter := time.Duration(rand.Int64N(int64(backoff)/5*2+1)) - backoff/5
+	return backoff + jitter, true
+}
+
+// otelProxyRetryInfo returns the delay of a RetryInfo detail in st, or zero if there is none.
+func otelProxyRetryInfo(st *status.Status) time.Duration {
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok && info.GetRetryDelay() != nil {
+			return info.GetRetryDelay().AsDuration()
+		}
+	}
+	return 0
+}
+
+type otelProxyBufferConfig struct {
+	queueSize    int64
+	maxBatchSize int64
+	batchTimeout time.Duration
+}
+
+// otelProxyBuffer queues spans for one upstream and exports them in batches from a background goroutine.
+type otelProxyBuffer struct {
+	otelProxyBufferConfig
+
+	u      *otelProxyUpstream
+	ctx    context.Context
+	cancel context.CancelFunc
+	flush  chan struct{}
+	stopCh chan struct{}
+	done   chan struct{}
+
+	mu     sync.Mutex
+	queue  []*tracepb.ResourceSpans
+	spans  int64
+	closed bool
+}
+
+func (b *otelProxyBuffer) start() {
+	b.ctx, b.cancel = context.WithCancel(b.u.p.ctx)
+	b.flush = make(chan struct{}, 1)
+	b.stopCh = make(chan struct{})
+	b.done = make(chan struct{})
+	go b.run()
+}
+
+// enqueue adds the resource spans to the queue and returns the number of spans that were rejected.
+func (b *otelProxyBuffer) enqueue(ctx context.Context, resourceSpans []*tracepb.ResourceSpans) int64 {
+	var rejected int64
+	var overflow []*tracepb.ResourceSpans
+
+	b.mu.Lock()
+	for _, rs := range resourceSpans {
+		n := otelProxyCountSpans(rs)
+		if b.closed || b.spans+n > b.queueSize {
+			overflow = append(overflow, rs)
+			rejected += n
+			continue
+		}
+		b.queue = append(b.queue, rs)
+		b.spans += n
+	}
+	full := b.spans >= b.maxBatchSize
+	b.mu.Unlock()
+
+	if full {
+		select {
+		case b.flush <- struct{}{}:
+		default:
+		}
+	}
+
+	if len(overflow) > 0 && b.u.spillDir != "" {
+		if err := b.u.spill(ctx, &coltracepb.ExportTraceServiceRequest{ResourceSpans: overflow}); err != nil {
+			ctxslog.FromContext(ctx).ErrorContext(ctx, "failed to spill spans to disk", slog.Int64("spans", rejected), slog.Any("err", err))
+			return rejected
+		}
+		return 0
+	}
+	return rejected
+}
+
+// dequeue removes up to maxBatchSize spans from the queue. A single resource span bigger than
+// maxBatchSize is never split and forms its own batch.
+func (b *otelProxyBuffer) dequeue() []*tracepb.ResourceSpans {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var n int64
+	i := 0
+	for ; i < len(b.queue); i++ {
+		c := otelProxyCountSpans(b.queue[i])
+		if i > 0 && n+c > b.maxBatchSize {
+			break
+		}
+		n += c
+	}
+	batch := slices.Clone(b.queue[:i])
+	b.queue = slices.Delete(b.queue, 0, i)
+	b.spans -= n
+	return batch
+}
+
+func (b *otelProxyBuffer) run() {
+	defer close(b.done)
+
+	b.u.replaySpilled(b.ctx)
+
+	ticker := time.NewTicker(b.batchTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stopCh:
+			for b.exportBatch() {
+			}
+			return
+		case <-ticker.C:
+			for b.exportBatch() {
+			}
+			b.u.replaySpilled(b.ctx)
+		case <-b.flush:
+			b.exportBatch()
+		}
+	}
+}
+
+// exportBatch exports one batch from the queue and reports whether the queue had anything in it.
+func (b *otelProxyBuffer) exportBatch() bool {
+	batch := b.dequeue()
+	if len(batch) == 0 {
+		return false
+	}
+
+	req := &coltracepb.ExportTraceServiceRequest{ResourceSpans: batch}
+	resp, err := b.u.p.retry.export(b.ctx, b.u.client, req)
+	if err != nil {
+		_, retryable := otelProxyRetryDelay(err, time.Second)
+		if (retryable || b.ctx.Err() != nil) && b.u.spillDir != "" {
+			spillErr := b.u.spill(b.ctx, req)
+			if spillErr == nil {
+				return true
+			}
+			ctxslog.FromContext(b.ctx).ErrorContext(b.ctx, "failed to spill spans to disk", slog.Any("err", spillErr))
+		}
+		spans := otelProxyCountRequestSpans(req)
+		ctxslog.FromContext(b.ctx).ErrorContext(b.ctx, "dropping spans after failing to export them to gRPC collector",
+			slog.String("endpoint", b.u.endpoint), slog.Int64("spans", spans), slog.Any("err", err))
+		b.u.p.telemetry.reject(b.ctx, spans, otelProxyRejectUpstream)
+		return true
+	}
+	if ps := resp.GetPartialSuccess(); ps != nil && ps.GetRejectedSpans() > 0 {
+		ctxslog.FromContext(b.ctx).WarnContext(b.ctx, "gRPC collector rejected spans",
+			slog.String("endpoint", b.u.endpoint), slog.Int64("rejected", ps.GetRejectedSpans()), slog.String("message", ps.GetErrorMessage()))
+	}
+	return true
+}
+
+// stop stops accepting spans and flushes the queue. Exports still running when ctx is done are aborted
+// and their batches spilled to disk if possible.
+func (b *otelProxyBuffer) stop(ctx context.Context) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	b.mu.Unlock()
+
+	stopAbort := context.AfterFunc(ctx, b.cancel)
+	defer stopAbort()
+	close(b.stopCh)
+	<-b.done
+	b.cancel()
+}
+
+var otelProxySpillSeq atomic.Uint64
+
+// spill writes req into the spill directory and drops the oldest spilled batches if that exceeds the spill limit.
+// The file is written under a temporary name and renamed so that replaySpilled never sees partially written batches.
+func (u *otelProxyUpstream) spill(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) error {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	u.spillMu.Lock()
+	defer u.spillMu.Unlock()
+	name := fmt.Sprintf("%020d-%06d.pb", time.Now().UnixNano(), otelProxySpillSeq.Add(1)%1_000_000)
+	tmp := filepath.Join(u.spillDir, "."+name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(u.spillDir, name)); err != nil {
+		return err
+	}
+	return u.trimSpilled(ctx)
+}
+
+// trimSpilled removes the oldest spilled batches until the rest fit into the spill limit.
+func (u *otelProxyUpstream) trimSpilled(ctx context.Context) error {
+	entries, err := os.ReadDir(u.spillDir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		if !otelProxySpillFile(entry) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Replayed in the meantime.
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+
+	var dropped, droppedFiles int64
+	// File names start with the time they were spilled at, so ReadDir returns the oldest first.
+	for _, info := range files {
+		if total <= u.p.spillLimit {
+			break
+		}
+		path := filepath.Join(u.spillDir, info.Name())
+		var req coltracepb.ExportTraceServiceRequest
+		if data, err := os.ReadFile(path); err == nil && proto.Unmarshal(data, &req) == nil {
+			dropped += otelProxyCountRequestSpans(&req)
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		total -= info.Size()
+		droppedFiles++
+	}
+	if droppedFiles > 0 {
+		ctxslog.FromContext(ctx).WarnContext(ctx, "spill directory is full, dropped the oldest spilled spans",
+			slog.String("endpoint", u.endpoint), slog.Int64("files", droppedFiles), slog.Int64("spans", dropped))
+		u.p.telemetry.reject(ctx, dropped, otelProxyRejectSpillFull)
+	}
+	return nil
+}
+
+// replaySpilled sends spilled batches to the collector, oldest first, and stops at the first failure.
+// Each batch is tried only once per call so that an unreachable collector does not block the queue.
+func (u *otelProxyUpstream) replaySpilled(ctx context.Context) {
+	if u.spillDir == "" {
+		return
+	}
+	logger := ctxslog.FromContext(ctx)
+	entries, err := os.ReadDir(u.spillDir)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to read spill directory", slog.Any("err", err))
+		return
+	}
+	for _, entry := range entries {
+		if !otelProxySpillFile(entry) {
+			continue
+		}
+		path := filepath.Join(u.spillDir, entry.Name())
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			// Dropped by trimSpilled in the meantime.
+			continue
+		}
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to read spilled spans", slog.String("file", entry.Name()), slog.Any("err", err))
+			return
+		}
+		var req coltracepb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			logger.WarnContext(ctx, "removing corrupt spilled spans", slog.String("file", entry.Name()), slog.Any("err", err))
+			_ = os.Remove(path)
+			continue
+		}
+		if _, err := u.client.Export(ctx, &req); err != nil {
+			if _, retryable := otelProxyRetryDelay(err, time.Second); retryable {
+				return
+			}
+			logger.ErrorContext(ctx, "dropping spilled spans rejected by gRPC collector", slog.String("file", entry.Name()), slog.Any("err", err))
+			u.p.telemetry.reject(ctx, otelProxyCountRequestSpans(&req), otelProxyRejectUpstream)
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.ErrorContext(ctx, "failed to remove spilled spans", slog.String("file", entry.Name()), slog.Any("err", err))
+			return
+		}
+	}
+}
+
+// otelProxySpillFile reports whether entry is a spilled batch rather than a temporary file or an upstream's directory.
+func otelProxySpillFile(entry os.DirEntry) bool {
+	return !entry.IsDir() && strings.HasSuffix(entry.Name(), ".pb") && !strings.HasPrefix(entry.Name(), ".")
+}
+
+func otelProxyCountSpans(rs *tracepb.ResourceSpans) int64 {
+	var n int64
+	for _, ss := range rs.GetScopeSpans() {
+		n += int64(len(ss.GetSpans()))
+	}
+	return n
+}
+
+func otelProxyCountRequestSpans(req *coltracepb.ExportTraceServiceRequest) int64 {
+	var n int64
+	for _, rs := range req.GetResourceSpans() {
+		n += otelProxyCountSpans(rs)
+	}
+	return n
+}
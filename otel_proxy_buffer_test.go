@@ -0,0 +1,324 @@
+package odj
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/metric/noop"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// fakeTraceClient answers exports with errs in turn and succeeds once they are used up.
+type fakeTraceClient struct {
+	mu       sync.Mutex
+	errs     []error
+	calls    int
+	exported []string
+}
+
+func (c *fakeTraceClient) Export(_ context.Context, req *coltracepb.ExportTraceServiceRequest, _ ...grpc.CallOption) (*coltracepb.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, rs := range req.GetResourceSpans() {
+		for _, ss := range rs.GetScopeSpans() {
+			for _, span := range ss.GetSpans() {
+				c.exported = append(c.exported, span.GetName())
+			}
+		}
+	}
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+// newTestOtelProxy creates a proxy with a single route whose upstream exports through client instead of gRPC.
+// A buffer is set up but not started, so tests drive it themselves.
+func newTestOtelProxy(t *testing.T, client coltracepb.TraceServiceClient, opts ...OtelProxyOption) (*OtelProxy, *otelProxyUpstream) {
+	t.Helper()
+	p := &OtelProxy{
+		ctx:        context.Background(),
+		upstreams:  make(map[string]*otelProxyUpstream),
+		retry:      otelProxyRetry{initialInterval: time.Millisecond, maxInterval: time.Millisecond, maxElapsedTime: time.Second},
+		spillLimit: defaultOtelProxySpillLimit,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	var err error
+	if p.telemetry, err = newOtelProxyTelemetry(noop.NewMeterProvider()); err != nil {
+		t.Fatal(err)
+	}
+	u := &otelProxyUpstream{p: p, endpoint: "collector", client: client, spillDir: p.spillDir}
+	if p.buffer != nil {
+		u.buffer = &otelProxyBuffer{otelProxyBufferConfig: *p.buffer, u: u, ctx: context.Background()}
+	}
+	p.upstreams[""] = u
+	p.routes = []*otelProxyRoute{{OtelProxyRoute: OtelProxyRoute{SrcComponent: "web"}, upstream: u}}
+	return p, u
+}
+
+// spansRequest returns a request with one resource span per name, each holding one span of that name.
+func spansRequest(names ...string) *coltracepb.ExportTraceServiceRequest {
+	req := &coltracepb.ExportTraceServiceRequest{}
+	for _, name := range names {
+		req.ResourceSpans = append(req.ResourceSpans, &tracepb.ResourceSpans{
+			ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{{Name: name}}}},
+		})
+	}
+	return req
+}
+
+// postSpans sends req to the proxy as OTLP/HTTP protobuf request.
+func postSpans(t *testing.T, p *OtelProxy, req *coltracepb.ExportTraceServiceRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/v1/traces", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	w := httptest.NewRecorder()
+	p.traces(w, r)
+	return w
+}
+
+func retryInfoStatus(t *testing.T, code codes.Code, delay time.Duration) *status.Status {
+	t.Helper()
+	st, err := status.New(code, "throttled").WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestOtelProxyRetryDelay(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantRetryable bool
+		wantDelay     time.Duration
+	}{
+		{name: "unavailable", err: status.Error(codes.Unavailable, ""), wantRetryable: true},
+		{name: "deadline exceeded", err: status.Error(codes.DeadlineExceeded, ""), wantRetryable: true},
+		{name: "aborted", err: status.Error(codes.Aborted, ""), wantRetryable: true},
+		{name: "data loss", err: status.Error(codes.DataLoss, ""), wantRetryable: true},
+		{name: "unavailable with retry info", err: retryInfoStatus(t, codes.Unavailable, 3*time.Second).Err(), wantRetryable: true, wantDelay: 3 * time.Second},
+		{name: "resource exhausted with retry info", err: retryInfoStatus(t, codes.ResourceExhausted, 2*time.Second).Err(), wantRetryable: true, wantDelay: 2 * time.Second},
+		{name: "resource exhausted without retry info", err: status.Error(codes.ResourceExhausted, "")},
+		{name: "invalid argument", err: status.Error(codes.InvalidArgument, "")},
+		{name: "unauthenticated", err: status.Error(codes.Unauthenticated, "")},
+		{name: "not a status", err: errors.New("boom")},
+	}
+	backoff := time.Second
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, retryable := otelProxyRetryDelay(tt.err, backoff)
+			if retryable != tt.wantRetryable {
+				t.Fatalf("got retryable %v, want %v", retryable, tt.wantRetryable)
+			}
+			switch {
+			case !retryable:
+			case tt.wantDelay > 0:
+				if delay != tt.wantDelay {
+					t.Errorf("got delay %v, want the server's %v", delay, tt.wantDelay)
+				}
+			case delay < backoff*4/5 || delay > backoff*6/5:
+				t.Errorf("got delay %v, want %v ±20%%", delay, backoff)
+			}
+		})
+	}
+}
+
+func TestOtelProxyRetryExport(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "down")
+	tests := []struct {
+		name           string
+		errs           []error
+		maxElapsedTime time.Duration
+		wantCalls      int
+		wantErr        bool
+	}{
+		{name: "success", wantCalls: 1},
+		{name: "retries retryable errors", errs: []error{unavailable, unavailable}, maxElapsedTime: time.Second, wantCalls: 3},
+		{name: "does not retry permanent errors", errs: []error{status.Error(codes.InvalidArgument, "bad")}, maxElapsedTime: time.Second, wantCalls: 1, wantErr: true},
+		{name: "zero max elapsed time disables retries", errs: []error{unavailable}, wantCalls: 1, wantErr: true},
+		{name: "gives up after max elapsed time", errs: slices.Repeat([]error{unavailable}, 100), maxElapsedTime: 20 * time.Millisecond, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeTraceClient{errs: tt.errs}
+			retry := otelProxyRetry{initialInterval: time.Millisecond, maxInterval: 4 * time.Millisecond, maxElapsedTime: tt.maxElapsedTime}
+			_, err := retry.export(context.Background(), client, spansRequest("a"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantCalls > 0 && client.calls != tt.wantCalls {
+				t.Errorf("got %d calls, want %d", client.calls, tt.wantCalls)
+			}
+			if tt.wantCalls == 0 && (client.calls < 2 || client.calls >= 100) {
+				t.Errorf("got %d calls, want retries until the budget is used up", client.calls)
+			}
+		})
+	}
+}
+
+func TestOtelProxyBufferOverflow(t *testing.T) {
+	p, u := newTestOtelProxy(t, &fakeTraceClient{}, OtelProxyWithBuffer(3, 3, time.Minute))
+
+	tests := []struct {
+		name           string
+		spans          []string
+		wantCode       int
+		wantRejected   int64
+		wantRetryAfter string
+	}{
+		{name: "fits", spans: []string{"a", "b"}, wantCode: http.StatusOK},
+		{name: "partly fits", spans: []string{"c", "d"}, wantCode: http.StatusOK, wantRejected: 1},
+		{name: "full", spans: []string{"e"}, wantCode: http.StatusServiceUnavailable, wantRetryAfter: "60"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postSpans(t, p, spansRequest(tt.spans...))
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("got Retry-After %q, want %q", got, tt.wantRetryAfter)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var resp coltracepb.ExportTraceServiceResponse
+			if err := proto.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.GetPartialSuccess().GetRejectedSpans(); got != tt.wantRejected {
+				t.Errorf("got %d rejected spans, want %d", got, tt.wantRejected)
+			}
+		})
+	}
+
+	if got := otelProxyCountRequestSpans(&coltracepb.ExportTraceServiceRequest{ResourceSpans: u.buffer.dequeue()}); got != 3 {
+		t.Errorf("got %d queued spans, want 3", got)
+	}
+}
+
+func TestOtelProxyBufferSpillAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	client := &fakeTraceClient{errs: []error{status.Error(codes.Unavailable, "down")}}
+	p, u := newTestOtelProxy(t, client, OtelProxyWithBuffer(1, 1, time.Minute), OtelProxyWithSpillDir(dir))
+	p.retry.maxElapsedTime = 0
+	ctx := context.Background()
+
+	// The first span is queued, the second does not fit into memory and is spilled right away.
+	if rejected := u.buffer.enqueue(ctx, spansRequest("queued", "overflow").GetResourceSpans()); rejected != 0 {
+		t.Fatalf("got %d rejected spans, want 0", rejected)
+	}
+	// The collector is down, so the queued span is spilled as well.
+	if !u.buffer.exportBatch() {
+		t.Fatal("expected a batch to export")
+	}
+	if files := spillFiles(t, dir); len(files) != 2 {
+		t.Fatalf("got %d spilled batches, want 2", len(files))
+	}
+
+	u.replaySpilled(ctx)
+	if want := []string{"overflow", "queued"}; !slices.Equal(client.exported, want) {
+		t.Errorf("got replayed spans %v, want %v", client.exported, want)
+	}
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Errorf("got %d spilled batches after replay, want 0", len(files))
+	}
+}
+
+func TestOtelProxyReplayStopsAtRetryableError(t *testing.T) {
+	dir := t.TempDir()
+	client := &fakeTraceClient{errs: []error{status.Error(codes.InvalidArgument, "bad"), status.Error(codes.Unavailable, "down")}}
+	_, u := newTestOtelProxy(t, client, OtelProxyWithBuffer(1, 1, time.Minute), OtelProxyWithSpillDir(dir))
+	ctx := context.Background()
+	for _, name := range []string{"rejected", "retried", "waiting"} {
+		if err := u.spill(ctx, spansRequest(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".partial.pb.tmp"), []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The permanently rejected batch is dropped, the unavailable collector stops the replay.
+	u.replaySpilled(ctx)
+	if files := spillFiles(t, dir); len(files) != 2 {
+		t.Fatalf("got %d spilled batches after a failed replay, want 2", len(files))
+	}
+	u.replaySpilled(ctx)
+	if want := []string{"retried", "waiting"}; !slices.Equal(client.exported, want) {
+		t.Errorf("got replayed spans %v, want %v", client.exported, want)
+	}
+}
+
+func TestOtelProxySpillLimit(t *testing.T) {
+	dir := t.TempDir()
+	size := int64(proto.Size(spansRequest("batch-0")))
+	_, u := newTestOtelProxy(t, &fakeTraceClient{}, OtelProxyWithSpillDir(dir), OtelProxyWithSpillLimit(size*5/2))
+	ctx := context.Background()
+	for i := range 5 {
+		if err := u.spill(ctx, spansRequest("batch-"+strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the two newest batches fit into two and a half batches.
+	var got []string
+	for _, file := range spillFiles(t, dir) {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var req coltracepb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, req.GetResourceSpans()[0].GetScopeSpans()[0].GetSpans()[0].GetName())
+	}
+	if want := []string{"batch-3", "batch-4"}; !slices.Equal(got, want) {
+		t.Errorf("got spilled batches %v, want %v", got, want)
+	}
+}
+
+func spillFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, entry := range entries {
+		if otelProxySpillFile(entry) {
+			files = append(files, entry.Name())
+		}
+	}
+	return files
+}
@@ -0,0 +1,108 @@
+package odj
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/go-faster/jx"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// unmarshalOTLPJSON decodes an OTLP/JSON payload, e.g. an ExportTraceServiceRequest, ExportMetricsServiceRequest or
+// ExportLogsServiceRequest, into msg.
+//
+// OTLP/JSON is the proto3 JSON mapping with one exception: trace_id, span_id and parent_span_id are hex strings
+// instead of base64. The payload is streamed once alongside the message descriptor and only those fields, wherever
+// they appear in the schema (spans, span links, log records, exemplars), are rewritten before protojson takes over.
+// Field names in lowerCamelCase or snake_case, enum names or numbers and unknown fields are accepted as the spec requires.
+func unmarshalOTLPJSON(data []byte, msg proto.Message) error {
+	d := jx.DecodeBytes(data)
+	e := jx.GetEncoder()
+	defer jx.PutEncoder(e)
+
+	if err := otlpJSONRewriteMessage(d, e, msg.ProtoReflect().Descriptor()); err != nil {
+		return fmt.Errorf("invalid OTLP/JSON payload: %w", err)
+	}
+
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(e.Bytes(), msg)
+}
+
+func otlpJSONRewriteMessage(d *jx.Decoder, e *jx.Encoder, md protoreflect.MessageDescriptor) error {
+	if d.Next() != jx.Object {
+		return otlpJSONCopy(d, e)
+	}
+	e.ObjStart()
+	err := d.ObjBytes(func(d *jx.Decoder, key []byte) error {
+		e.FieldStart(string(key))
+		fd := md.Fields().ByJSONName(string(key))
+		if fd == nil {
+			fd = md.Fields().ByTextName(string(key))
+		}
+		if fd == nil || fd.IsMap() {
+			return otlpJSONCopy(d, e)
+		}
+		if fd.IsList() {
+			if d.Next() != jx.Array {
+				return otlpJSONCopy(d, e)
+			}
+			e.ArrStart()
+			if err := d.Arr(func(d *jx.Decoder) error {
+				return otlpJSONRewriteValue(d, e, fd)
+			}); err != nil {
+				return err
+			}
+			e.ArrEnd()
+			return nil
+		}
+		return otlpJSONRewriteValue(d, e, fd)
+	})
+	if err != nil {
+		return err
+	}
+	e.ObjEnd()
+	return nil
+}
+
+func otlpJSONRewriteValue(d *jx.Decoder, e *jx.Encoder, fd protoreflect.FieldDescriptor) error {
+	switch {
+	case fd.Kind() == protoreflect.MessageKind:
+		return otlpJSONRewriteMessage(d, e, fd.Message())
+	case otlpJSONIsHexID(fd) && d.Next() == jx.String:
+		s, err := d.Str()
+		if err != nil {
+			return err
+		}
+		id, err := hex.DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("%s is not a hex encoded id: %w", fd.JSONName(), err)
+		}
+		e.Base64(id)
+		return nil
+	default:
+		return otlpJSONCopy(d, e)
+	}
+}
+
+// otlpJSONIsHexID reports whether fd is one of the id fields that OTLP/JSON encodes as hex.
+func otlpJSONIsHexID(fd protoreflect.FieldDescriptor) bool {
+	if fd.Kind() != protoreflect.BytesKind {
+		return false
+	}
+	switch fd.Name() {
+	case "trace_id", "span_id", "parent_span_id":
+		return true
+	default:
+		return false
+	}
+}
+
+func otlpJSONCopy(d *jx.Decoder, e *jx.Encoder) error {
+	raw, err := d.Raw()
+	if err != nil {
+		return err
+	}
+	e.Raw(raw)
+	return nil
+}
@@ -0,0 +1,234 @@
+package odj
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func strAttr(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func exampleResource() *resourcepb.Resource {
+	return &resourcepb.Resource{Attributes: []*commonpb.KeyValue{strAttr("service.name", "my.service")}}
+}
+
+func exampleScope() *commonpb.InstrumentationScope {
+	return &commonpb.InstrumentationScope{
+		Name:       "my.library",
+		Version:    "1.0.0",
+		Attributes: []*commonpb.KeyValue{strAttr("my.scope.attribute", "some scope attribute")},
+	}
+}
+
+func readExample(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "otlp", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func assertProtoEqual(t *testing.T, got, want proto.Message) {
+	t.Helper()
+	if !proto.Equal(got, want) {
+		t.Errorf("decoded message differs\ngot:  %v\nwant: %v", prototext.Format(got), prototext.Format(want))
+	}
+}
+
+// The examples in testdata/otlp are those of the opentelemetry-proto repository.
+func TestUnmarshalOTLPJSONExamples(t *testing.T) {
+	t.Run("trace", func(t *testing.T) {
+		var got coltracepb.ExportTraceServiceRequest
+		if err := unmarshalOTLPJSON(readExample(t, "trace.json"), &got); err != nil {
+			t.Fatal(err)
+		}
+		assertProtoEqual(t, &got, &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: exampleResource(),
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Scope: exampleScope(),
+				Spans: []*tracepb.Span{{
+					TraceId:           mustHex(t, "5b8efff798038103d269b633813fc60c"),
+					SpanId:            mustHex(t, "eee19b7ec3c1b174"),
+					ParentSpanId:      mustHex(t, "eee19b7ec3c1b173"),
+					Name:              "I'm a server span",
+					StartTimeUnixNano: 1544712660000000000,
+					EndTimeUnixNano:   1544712661000000000,
+					Kind:              tracepb.Span_SPAN_KIND_SERVER,
+					Attributes:        []*commonpb.KeyValue{strAttr("my.span.attr", "some value")},
+				}},
+			}},
+		}}})
+	})
+
+	t.Run("logs", func(t *testing.T) {
+		var got collogspb.ExportLogsServiceRequest
+		if err := unmarshalOTLPJSON(readExample(t, "logs.json"), &got); err != nil {
+			t.Fatal(err)
+		}
+		assertProtoEqual(t, &got, &collogspb.ExportLogsServiceRequest{ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: exampleResource(),
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope: exampleScope(),
+				LogRecords: []*logspb.LogRecord{{
+					TimeUnixNano:         1544712660300000000,
+					ObservedTimeUnixNano: 1544712660300000000,
+					SeverityNumber:       logspb.SeverityNumber_SEVERITY_NUMBER_INFO2,
+					SeverityText:         "Information",
+					TraceId:              mustHex(t, "5b8efff798038103d269b633813fc60c"),
+					SpanId:               mustHex(t, "eee19b7ec3c1b174"),
+					Body:                 &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "Example log record"}},
+					Attributes: []*commonpb.KeyValue{
+						strAttr("string.attribute", "some string"),
+						{Key: "boolean.attribute", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: true}}},
+						{Key: "int.attribute", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 10}}},
+						{Key: "double.attribute", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: 637.704}}},
+						{Key: "array.attribute", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{
+							Values: []*commonpb.AnyValue{
+								{Value: &commonpb.AnyValue_StringValue{StringValue: "many"}},
+								{Value: &commonpb.AnyValue_StringValue{StringValue: "values"}},
+							},
+						}}}},
+						{Key: "map.attribute", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+							Values: []*commonpb.KeyValue{strAttr("some.map.key", "some value")},
+						}}}},
+					},
+				}},
+			}},
+		}}})
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		var got colmetricspb.ExportMetricsServiceRequest
+		if err := unmarshalOTLPJSON(readExample(t, "metrics.json"), &got); err != nil {
+			t.Fatal(err)
+		}
+		metrics := got.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()
+		if len(metrics) != 4 {
+			t.Fatalf("got %d metrics, want 4", len(metrics))
+		}
+		if v := metrics[0].GetSum().GetDataPoints()[0].GetAsDouble(); v != 5 {
+			t.Errorf("got counter value %v, want 5", v)
+		}
+		if v := metrics[1].GetGauge().GetDataPoints()[0].GetAsDouble(); v != 10 {
+			t.Errorf("got gauge value %v, want 10", v)
+		}
+		if v := metrics[2].GetHistogram().GetDataPoints()[0].GetBucketCounts(); len(v) != 2 || v[0] != 1 || v[1] != 1 {
+			t.Errorf("got histogram bucket counts %v, want [1 1]", v)
+		}
+		if v := metrics[3].GetExponentialHistogram().GetDataPoints()[0].GetPositive().GetBucketCounts(); len(v) != 2 || v[1] != 2 {
+			t.Errorf("got exponential histogram bucket counts %v, want [0 2]", v)
+		}
+	})
+}
+
+func TestUnmarshalOTLPJSON(t *testing.T) {
+	traceID := "5b8efff798038103d269b633813fc60c"
+	spanID := "eee19b7ec3c1b174"
+
+	tests := []struct {
+		name    string
+		payload string
+		msg     proto.Message
+		want    proto.Message
+		wantErr bool
+	}{
+		{
+			name:    "hex ids in span links",
+			payload: `{"resourceSpans":[{"scopeSpans":[{"spans":[{"links":[{"traceId":"` + traceID + `","spanId":"` + spanID + `"}]}]}]}]}`,
+			msg:     &coltracepb.ExportTraceServiceRequest{},
+			want: &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{{
+				Links: []*tracepb.Span_Link{{TraceId: mustHex(t, traceID), SpanId: mustHex(t, spanID)}},
+			}}}}}}},
+		},
+		{
+			name:    "hex ids in log records",
+			payload: `{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"traceId":"` + traceID + `","spanId":"` + spanID + `"}]}]}]}`,
+			msg:     &collogspb.ExportLogsServiceRequest{},
+			want: &collogspb.ExportLogsServiceRequest{ResourceLogs: []*logspb.ResourceLogs{{ScopeLogs: []*logspb.ScopeLogs{{LogRecords: []*logspb.LogRecord{{
+				TraceId: mustHex(t, traceID), SpanId: mustHex(t, spanID),
+			}}}}}}},
+		},
+		{
+			name:    "attribute keys named like id fields are left unchanged",
+			payload: `{"resourceSpans":[{"scopeSpans":[{"spans":[{"attributes":[{"key":"traceId","value":{"stringValue":"` + traceID + `"}}]}]}]}]}`,
+			msg:     &coltracepb.ExportTraceServiceRequest{},
+			want: &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{{
+				Attributes: []*commonpb.KeyValue{strAttr("traceId", traceID)},
+			}}}}}}},
+		},
+		{
+			name:    "snake_case keys",
+			payload: `{"resource_spans":[{"scope_spans":[{"spans":[{"trace_id":"` + traceID + `","span_id":"` + spanID + `","parent_span_id":"` + spanID + `","start_time_unix_nano":"1"}]}]}]}`,
+			msg:     &coltracepb.ExportTraceServiceRequest{},
+			want: &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{{
+				TraceId: mustHex(t, traceID), SpanId: mustHex(t, spanID), ParentSpanId: mustHex(t, spanID), StartTimeUnixNano: 1,
+			}}}}}}},
+		},
+		{
+			name:    "enum names",
+			payload: `{"resourceSpans":[{"scopeSpans":[{"spans":[{"kind":"SPAN_KIND_CLIENT","status":{"code":"STATUS_CODE_ERROR"}}]}]}]}`,
+			msg:     &coltracepb.ExportTraceServiceRequest{},
+			want: &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{{
+				Kind: tracepb.Span_SPAN_KIND_CLIENT, Status: &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR},
+			}}}}}}},
+		},
+		{
+			name:    "unknown fields are ignored",
+			payload: `{"resourceSpans":[{"scopeSpans":[{"spans":[{"name":"a","futureField":{"traceId":"not hex"}}]}]}],"other":1}`,
+			msg:     &coltracepb.ExportTraceServiceRequest{},
+			want: &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{{
+				Name: "a",
+			}}}}}}},
+		},
+		{
+			name:    "invalid hex id",
+			payload: `{"resourceSpans":[{"scopeSpans":[{"spans":[{"traceId":"xyz"}]}]}]}`,
+			msg:     &coltracepb.ExportTraceServiceRequest{},
+			wantErr: true,
+		},
+		{
+			name:    "malformed json",
+			payload: `{"resourceSpans":[`,
+			msg:     &coltracepb.ExportTraceServiceRequest{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := unmarshalOTLPJSON([]byte(tt.payload), tt.msg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertProtoEqual(t, tt.msg, tt.want)
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package odj
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"slices"
+	"strings"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// OtelProxyRedacted is the value that replaces redacted attribute values.
+const OtelProxyRedacted = "[REDACTED]"
+
+// OtelProxyProcessor modifies a batch of resource spans before it is forwarded to the collector.
+// Processors run in the order they are given and before the proxy enforces its own resource attributes.
+type OtelProxyProcessor func(rs *tracepb.ResourceSpans)
+
+// OtelProxyWithProcessors appends processors to the pipeline that every incoming payload passes through.
+func OtelProxyWithProcessors(processors ...OtelProxyProcessor) OtelProxyOption {
+	return func(p *OtelProxy) {
+		p.processors = append(p.processors, processors...)
+	}
+}
+
+// OtelProxyRedactKeys returns a processor that replaces the values of the given resource, scope, span, event and link
+// attributes with OtelProxyRedacted.
+func OtelProxyRedactKeys(keys ...string) OtelProxyProcessor {
+	return otelProxyAttributeProcessor(func(attrs []*commonpb.KeyValue) []*commonpb.KeyValue {
+		for _, kv := range attrs {
+			if slices.Contains(keys, kv.GetKey()) {
+				kv.Value = otelProxyStringValue(OtelProxyRedacted)
+			}
+		}
+		return attrs
+	})
+}
+
+// OtelProxyRedactValues returns a processor that replaces every match of pattern in string attribute values,
+// including values nested in arrays and maps, with OtelProxyRedacted.
+// e.g. regexp.MustCompile(`[\w.+-]+@[\w-]+\.[\w.-]+`) to scrub email addresses.
+func OtelProxyRedactValues(pattern *regexp.Regexp) OtelProxyProcessor {
+	return otelProxyAttributeProcessor(func(attrs []*commonpb.KeyValue) []*commonpb.KeyValue {
+		for _, kv := range attrs {
+			otelProxyMapStrings(kv.GetValue(), func(s string) string {
+				return pattern.ReplaceAllLiteralString(s, OtelProxyRedacted)
+			})
+		}
+		return attrs
+	})
+}
+
+// OtelProxyStripURLQuery returns a processor that removes the query string and fragment from URL valued attributes.
+// If no keys are given, the semantic convention keys url.full, url.query, http.url and http.target are used.
+func OtelProxyStripURLQuery(keys ...string) OtelProxyProcessor {
+	if len(keys) == 0 {
+		keys = []string{"url.full", "url.query", "http.url", "http.target"}
+	}
+	return otelProxyAttributeProcessor(func(attrs []*commonpb.KeyValue) []*commonpb.KeyValue {
+		for _, kv := range attrs {
+			if !slices.Contains(keys, kv.GetKey()) {
+				continue
+			}
+			otelProxyMapStrings(kv.GetValue(), otelProxyStripQuery(kv.GetKey()))
+		}
+		return attrs
+	})
+}
+
+// OtelProxyDropAttributes returns a processor that removes the given resource, scope, span, event and link attributes entirely.
+func OtelProxyDropAttributes(keys ...string) OtelProxyProcessor {
+	return otelProxyAttributeProcessor(func(attrs []*commonpb.KeyValue) []*commonpb.KeyValue {
+		return slices.DeleteFunc(attrs, func(kv *commonpb.KeyValue) bool {
+			return slices.Contains(keys, kv.GetKey())
+		})
+	})
+}
+
+// OtelProxyHashAttributes returns a processor that replaces the values of the given attributes, e.g. user.id or enduser.id,
+// with their hex encoded HMAC-SHA256 keyed by secret. The same identifier always maps to the same hash, so spans of one user
+// can still be correlated without exposing the identifier itself.
+func OtelProxyHashAttributes(secret []byte, keys ...string) OtelProxyProcessor {
+	return otelProxyAttributeProcessor(func(attrs []*commonpb.KeyValue) []*commonpb.KeyValue {
+		for _, kv := range attrs {
+			if !slices.Contains(keys, kv.GetKey()) {
+				continue
+			}
+			otelProxyMapStrings(kv.GetValue(), func(s string) string {
+				mac := hmac.New(sha256.New, secret)
+				_, _ = mac.Write([]byte(s))
+				return hex.EncodeToString(mac.Sum(nil))
+			})
+		}
+		return attrs
+	})
+}
+
+func (p *OtelProxy) process(resourceSpans []*tracepb.ResourceSpans) {
+	for _, rs := range resourceSpans {
+		for _, processor := range p.processors {
+			processor(rs)
+		}
+	}
+}
+
+// otelProxyAttributeProcessor applies fn to every attribute list of the resource, its instrumentation scopes, spans,
+// span events and span links.
+func otelProxyAttributeProcessor(fn func([]*commonpb.KeyValue) []*commonpb.KeyValue) OtelProxyProcessor {
+	return func(rs *tracepb.ResourceSpans) {
+		if rs.GetResource() != nil {
+			rs.Resource.Attributes = fn(rs.Resource.Attributes)
+		}
+		for _, ss := range rs.GetScopeSpans() {
+			if ss.GetScope() != nil {
+				ss.Scope.Attributes = fn(ss.Scope.Attributes)
+			}
+			for _, span := range ss.GetSpans() {
+				span.Attributes = fn(span.Attributes)
+				for _, event := range span.GetEvents() {
+					event.Attributes = fn(event.Attributes)
+				}
+				for _, link := range span.GetLinks() {
+					link.Attributes = fn(link.Attributes)
+				}
+			}
+		}
+	}
+}
+
+// otelProxyMapStrings replaces every string in v, including strings nested in arrays and maps, with fn(string).
+func otelProxyMapStrings(v *commonpb.AnyValue, fn func(string) string) {
+	switch val := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		val.StringValue = fn(val.StringValue)
+	case *commonpb.AnyValue_ArrayValue:
+		for _, item := range val.ArrayValue.GetValues() {
+			otelProxyMapStrings(item, fn)
+		}
+	case *commonpb.AnyValue_KvlistValue:
+		for _, kv := range val.KvlistValue.GetValues() {
+			otelProxyMapStrings(kv.GetValue(), fn)
+		}
+	}
+}
+
+// otelProxyStripQuery cuts s at the first query or fragment marker. Values of url.query hold nothing but the query
+// and are emptied entirely.
+func otelProxyStripQuery(key string) func(string) string {
+	return func(s string) string {
+		if key == "url.query" {
+			return ""
+		}
+		if i := strings.IndexAny(s, "?#"); i >= 0 {
+			return s[:i]
+		}
+		return s
+	}
+}
+
+func otelProxyStringValue(s string) *commonpb.AnyValue {
+	return &commonpb.AnyValue{
+		Value: &commonpb.AnyValue_StringValue{
+			StringValue: s,
+		},
+	}
+}
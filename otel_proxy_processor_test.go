@@ -0,0 +1,163 @@
+package odj
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"testing"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// processorInput returns resource spans carrying attrs on the resource, the scope, a span, its event and its link,
+// so that a processor test checks every attribute list a processor has to reach.
+func processorInput(attrs ...*commonpb.KeyValue) *tracepb.ResourceSpans {
+	clone := func() []*commonpb.KeyValue {
+		kvs := make([]*commonpb.KeyValue, len(attrs))
+		for i, kv := range attrs {
+			kvs[i] = proto.CloneOf(kv)
+		}
+		return kvs
+	}
+	return &tracepb.ResourceSpans{
+		Resource: &resourcepb.Resource{Attributes: clone()},
+		ScopeSpans: []*tracepb.ScopeSpans{{
+			Scope: &commonpb.InstrumentationScope{Name: "scope", Attributes: clone()},
+			Spans: []*tracepb.Span{{
+				Name:       "span",
+				Attributes: clone(),
+				Events:     []*tracepb.Span_Event{{Name: "event", Attributes: clone()}},
+				Links:      []*tracepb.Span_Link{{Attributes: clone()}},
+			}},
+		}},
+	}
+}
+
+func TestOtelProxyProcessors(t *testing.T) {
+	hmacHex := func(s string) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		_, _ = mac.Write([]byte(s))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	listValue := func(values ...string) *commonpb.AnyValue {
+		list := &commonpb.ArrayValue{}
+		for _, v := range values {
+			list.Values = append(list.Values, otelProxyStringValue(v))
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: list}}
+	}
+	mapValue := func(key, value string) *commonpb.AnyValue {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+			Values: []*commonpb.KeyValue{strAttr(key, value)},
+		}}}
+	}
+	email := regexp.MustCompile(`[\w.+-]+@[\w-]+\.[\w.-]+`)
+
+	tests := []struct {
+		name      string
+		processor OtelProxyProcessor
+		attrs     []*commonpb.KeyValue
+		want      []*commonpb.KeyValue
+	}{
+		{
+			name:      "redact keys",
+			processor: OtelProxyRedactKeys("user.email"),
+			attrs:     []*commonpb.KeyValue{strAttr("user.email", "jane@example.com"), strAttr("http.method", "GET")},
+			want:      []*commonpb.KeyValue{strAttr("user.email", OtelProxyRedacted), strAttr("http.method", "GET")},
+		},
+		{
+			name:      "redact keys replaces non-string values",
+			processor: OtelProxyRedactKeys("user.roles"),
+			attrs:     []*commonpb.KeyValue{{Key: "user.roles", Value: listValue("admin", "billing")}},
+			want:      []*commonpb.KeyValue{strAttr("user.roles", OtelProxyRedacted)},
+		},
+		{
+			name:      "redact values",
+			processor: OtelProxyRedactValues(email),
+			attrs:     []*commonpb.KeyValue{strAttr("message", "sent to jane@example.com and joe@example.org")},
+			want:      []*commonpb.KeyValue{strAttr("message", "sent to [REDACTED] and [REDACTED]")},
+		},
+		{
+			name:      "redact values nested in arrays and maps",
+			processor: OtelProxyRedactValues(email),
+			attrs: []*commonpb.KeyValue{
+				{Key: "to", Value: listValue("jane@example.com", "nobody")},
+				{Key: "user", Value: mapValue("email", "jane@example.com")},
+			},
+			want: []*commonpb.KeyValue{
+				{Key: "to", Value: listValue(OtelProxyRedacted, "nobody")},
+				{Key: "user", Value: mapValue("email", OtelProxyRedacted)},
+			},
+		},
+		{
+			name:      "redact values leaves non-matching values",
+			processor: OtelProxyRedactValues(email),
+			attrs:     []*commonpb.KeyValue{strAttr("message", "no address"), {Key: "count", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 3}}}},
+			want:      []*commonpb.KeyValue{strAttr("message", "no address"), {Key: "count", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 3}}}},
+		},
+		{
+			name:      "strip url query with default keys",
+			processor: OtelProxyStripURLQuery(),
+			attrs: []*commonpb.KeyValue{
+				strAttr("url.full", "https://shop.example/cart?token=abc#top"),
+				strAttr("url.query", "token=abc"),
+				strAttr("http.url", "https://shop.example/cart#top"),
+				strAttr("http.target", "/cart?token=abc"),
+				strAttr("referer", "https://shop.example/?token=abc"),
+			},
+			want: []*commonpb.KeyValue{
+				strAttr("url.full", "https://shop.example/cart"),
+				strAttr("url.query", ""),
+				strAttr("http.url", "https://shop.example/cart"),
+				strAttr("http.target", "/cart"),
+				strAttr("referer", "https://shop.example/?token=abc"),
+			},
+		},
+		{
+			name:      "strip url query with given keys",
+			processor: OtelProxyStripURLQuery("referer"),
+			attrs:     []*commonpb.KeyValue{strAttr("referer", "https://shop.example/?token=abc"), strAttr("url.full", "https://shop.example/?a=1")},
+			want:      []*commonpb.KeyValue{strAttr("referer", "https://shop.example/"), strAttr("url.full", "https://shop.example/?a=1")},
+		},
+		{
+			name:      "drop attributes",
+			processor: OtelProxyDropAttributes("user.id", "session.id"),
+			attrs:     []*commonpb.KeyValue{strAttr("user.id", "42"), strAttr("http.method", "GET"), strAttr("session.id", "s")},
+			want:      []*commonpb.KeyValue{strAttr("http.method", "GET")},
+		},
+		{
+			name:      "hash attributes",
+			processor: OtelProxyHashAttributes([]byte("secret"), "user.id"),
+			attrs:     []*commonpb.KeyValue{strAttr("user.id", "42"), strAttr("http.method", "GET")},
+			want:      []*commonpb.KeyValue{strAttr("user.id", hmacHex("42")), strAttr("http.method", "GET")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := processorInput(tt.attrs...)
+			tt.processor(got)
+			assertProtoEqual(t, got, processorInput(tt.want...))
+		})
+	}
+}
+
+func TestOtelProxyHashAttributesIsStable(t *testing.T) {
+	hash := func(secret, id string) string {
+		rs := processorInput(strAttr("user.id", id))
+		OtelProxyHashAttributes([]byte(secret), "user.id")(rs)
+		return rs.GetResource().GetAttributes()[0].GetValue().GetStringValue()
+	}
+	if hash("secret", "42") != hash("secret", "42") {
+		t.Error("the same identifier hashes differently")
+	}
+	if hash("secret", "42") == hash("secret", "43") {
+		t.Error("different identifiers hash the same")
+	}
+	if hash("secret", "42") == hash("other", "42") {
+		t.Error("the hash does not depend on the secret")
+	}
+}
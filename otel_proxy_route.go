@@ -0,0 +1,173 @@
+package odj
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+)
+
+// OtelProxyRoute attributes the payloads of one client, e.g. one of several frontends served by the same proxy,
+// and optionally sends them to their own collector. A route matches a request if all of its non-empty
+// PathPrefix, Header and ClientUser criteria match.
+type OtelProxyRoute struct {
+	// PathPrefix makes the route serve PathPrefix + "/v1/traces", e.g. "/web-shop".
+	PathPrefix string
+	// HeaderName and HeaderValue require the request to carry the given header value.
+	// HeaderValue is required if HeaderName is set.
+	HeaderName  string
+	HeaderValue string
+	// ClientUser and ClientPass require the request to authenticate with these basic auth credentials.
+	// ClientPass is required if ClientUser is set.
+	ClientUser string
+	ClientPass string
+
+	// SrcComponent is enforced as service.name of the matched payloads.
+	SrcComponent string
+	// Stage is enforced as deployment environment of the matched payloads. Defaults to the proxy's Stage if empty.
+	Stage DeploymentStage
+	// Attributes are additional resource attributes enforced on the matched payloads.
+	Attributes map[string]string
+
+	// Endpoint, User and Pass select a different collector for the matched payloads.
+	// If Endpoint is empty, the collector given to NewOtelTraceProxy is used.
+	Endpoint string
+	User     string
+	Pass     string
+}
+
+// OtelProxyWithRoutes adds routes to the proxy. Routes are evaluated in order and the first matching one wins.
+func OtelProxyWithRoutes(routes ...OtelProxyRoute) OtelProxyOption {
+	return func(p *OtelProxy) {
+		for _, route := range routes {
+			p.routes = append(p.routes, &otelProxyRoute{OtelProxyRoute: route})
+		}
+	}
+}
+
+type otelProxyRoute struct {
+	OtelProxyRoute
+	attributes []*commonpb.KeyValue
+	upstream   *otelProxyUpstream
+}
+
+func (r *otelProxyRoute) matches(req *http.Request) bool {
+	if prefix := strings.TrimSuffix(r.PathPrefix, "/"); prefix != "" && req.URL.Path != prefix+"/v1/traces" {
+		return false
+	}
+	if r.HeaderName != "" && req.Header.Get(r.HeaderName) != r.HeaderValue {
+		return false
+	}
+	if r.ClientUser != "" {
+		user, pass, ok := req.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(r.ClientUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(r.ClientPass)) != 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// route returns the first route matching req, or nil.
+func (p *OtelProxy) route(req *http.Request) *otelProxyRoute {
+	for _, r := range p.routes {
+		if r.matches(req) {
+			return r
+		}
+	}
+	return nil
+}
+
+// otelProxyValidateRoute checks that route is complete. Criteria given only partly are refused rather than
+// matched against empty values, which requests without the header or with an empty password would satisfy.
+func otelProxyValidateRoute(route OtelProxyRoute) error {
+	if route.SrcComponent == "" {
+		return errors.New("otel proxy route source component is required")
+	}
+	if err := otelProxyValidatePathPrefix(route.PathPrefix); err != nil {
+		return err
+	}
+	if route.HeaderName != "" && route.HeaderValue == "" {
+		return fmt.Errorf("otel proxy route %s requires a value for its header %s", route.SrcComponent, route.HeaderName)
+	}
+	if route.HeaderName == "" && route.HeaderValue != "" {
+		return fmt.Errorf("otel proxy route %s requires a name for its header value", route.SrcComponent)
+	}
+	if route.ClientUser != "" && route.ClientPass == "" {
+		return fmt.Errorf("otel proxy route %s requires a password for its client user", route.SrcComponent)
+	}
+	if route.ClientUser == "" && route.ClientPass != "" {
+		return fmt.Errorf("otel proxy route %s requires a user for its client password", route.SrcComponent)
+	}
+	if route.Endpoint != "" && (route.User == "" || route.Pass == "") {
+		return fmt.Errorf("otel proxy route %s requires a user and password for its endpoint", route.SrcComponent)
+	}
+	return nil
+}
+
+// otelProxyValidatePathPrefix checks that prefix is an absolute, clean URL path without characters that have
+// a special meaning in ServeMux patterns or need escaping, so that the route is registered and matched as given.
+func otelProxyValidatePathPrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("otel proxy route path prefix %q must start with /", prefix)
+	}
+	for _, c := range prefix {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("/-._~!$&'()*+,;=:@", c)) {
+			return fmt.Errorf("otel proxy route path prefix %q contains the invalid character %q", prefix, c)
+		}
+	}
+	if trimmed := strings.TrimSuffix(prefix, "/"); trimmed != "" && path.Clean(trimmed) != trimmed {
+		return fmt.Errorf("otel proxy route path prefix %q must be a clean path", prefix)
+	}
+	return nil
+}
+
+func (p *OtelProxy) pathPrefixes() []string {
+	var prefixes []string
+	for _, r := range p.routes {
+		if prefix := strings.TrimSuffix(r.PathPrefix, "/"); prefix != "" && !slices.Contains(prefixes, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// otelProxyRouteAttributes returns the resource attributes the proxy enforces for payloads matching route.
+func otelProxyRouteAttributes(route OtelProxyRoute) []*commonpb.KeyValue {
+	stage := route.Stage
+	if stage == "" {
+		stage = Stage
+	}
+	attributes := []attribute.KeyValue{
+		attribute.String("otel_proxy.service.name", Component),
+		attribute.String("otel_proxy.service.version", FullVersion),
+		attribute.String("otel_proxy.deployment.environment", Stage.String()),
+		semconv.ServiceNameKey.String(route.SrcComponent),
+		semconv.DeploymentEnvironmentNameKey.String(stage.String()),
+	}
+	// Sorted, so that every payload carries the attributes in the same order.
+	for _, key := range slices.Sorted(maps.Keys(route.Attributes)) {
+		attributes = append(attributes, attribute.String(key, route.Attributes[key]))
+	}
+
+	kvs := make([]*commonpb.KeyValue, 0, len(attributes))
+	for _, attr := range attributes {
+		kvs = append(kvs, &commonpb.KeyValue{
+			Key:   string(attr.Key),
+			Value: otelProxyStringValue(attr.Value.AsString()),
+		})
+	}
+	return kvs
+}
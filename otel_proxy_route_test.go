@@ -0,0 +1,91 @@
+package odj
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOtelProxyValidatePathPrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		wantErr bool
+	}{
+		{prefix: ""},
+		{prefix: "/web-shop"},
+		{prefix: "/web-shop/"},
+		{prefix: "/apps/web_shop.v2"},
+		{prefix: "/"},
+		{prefix: "web-shop", wantErr: true},
+		{prefix: "/web shop", wantErr: true},
+		{prefix: "/{app}", wantErr: true},
+		{prefix: "/web-shop?x=1", wantErr: true},
+		{prefix: "/web-shop/../admin", wantErr: true},
+		{prefix: "//web-shop", wantErr: true},
+		{prefix: "/wéb", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			err := otelProxyValidatePathPrefix(tt.prefix)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// Valid prefixes must be accepted by ServeMux and matched by the route.
+			route := &otelProxyRoute{OtelProxyRoute: OtelProxyRoute{PathPrefix: tt.prefix}}
+			mux := http.NewServeMux()
+			for _, prefix := range (&OtelProxy{routes: []*otelProxyRoute{route}}).pathPrefixes() {
+				mux.HandleFunc(prefix+"/v1/traces", func(http.ResponseWriter, *http.Request) {})
+			}
+			req, err := http.NewRequest(http.MethodPost, "http://proxy"+strings.TrimSuffix(tt.prefix, "/")+"/v1/traces", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !route.matches(req) {
+				t.Errorf("route with prefix %q does not match %s", tt.prefix, req.URL.Path)
+			}
+		})
+	}
+}
+
+func TestOtelProxyValidateRoute(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   OtelProxyRoute
+		wantErr bool
+	}{
+		{name: "source component only", route: OtelProxyRoute{SrcComponent: "web"}},
+		{name: "header", route: OtelProxyRoute{SrcComponent: "web", HeaderName: "X-App", HeaderValue: "shop"}},
+		{name: "client credentials", route: OtelProxyRoute{SrcComponent: "web", ClientUser: "shop", ClientPass: "secret"}},
+		{name: "own collector", route: OtelProxyRoute{SrcComponent: "web", Endpoint: "collector:4317", User: "u", Pass: "p"}},
+		{name: "missing source component", route: OtelProxyRoute{PathPrefix: "/web"}, wantErr: true},
+		{name: "invalid path prefix", route: OtelProxyRoute{SrcComponent: "web", PathPrefix: "web"}, wantErr: true},
+		{name: "header without value", route: OtelProxyRoute{SrcComponent: "web", HeaderName: "X-App"}, wantErr: true},
+		{name: "header value without name", route: OtelProxyRoute{SrcComponent: "web", HeaderValue: "shop"}, wantErr: true},
+		{name: "client user without password", route: OtelProxyRoute{SrcComponent: "web", ClientUser: "shop"}, wantErr: true},
+		{name: "client password without user", route: OtelProxyRoute{SrcComponent: "web", ClientPass: "secret"}, wantErr: true},
+		{name: "collector without credentials", route: OtelProxyRoute{SrcComponent: "web", Endpoint: "collector:4317"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := otelProxyValidateRoute(tt.route); (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOtelProxyRouteAttributesAreSorted(t *testing.T) {
+	route := OtelProxyRoute{SrcComponent: "web", Attributes: map[string]string{"c": "3", "a": "1", "b": "2", "d": "4"}}
+	want := otelProxyRouteAttributes(route)
+	for range 20 {
+		got := otelProxyRouteAttributes(route)
+		for i := range want {
+			if got[i].GetKey() != want[i].GetKey() {
+				t.Fatalf("attribute %d is %s, previously %s", i, got[i].GetKey(), want[i].GetKey())
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package odj
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/pedramktb/go-ctxslog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// OtelProxyWithMeterProvider sets the meter provider used for the proxy's own metrics.
+// Defaults to the global meter provider.
+func OtelProxyWithMeterProvider(mp metric.MeterProvider) OtelProxyOption {
+	return func(p *OtelProxy) {
+		p.meterProvider = mp
+	}
+}
+
+// OtelProxyWithDebugSampling logs a summary of the given fraction (0 to 1) of incoming payloads at debug level,
+// e.g. resource and span counts and the span names. Payload contents such as attribute values are never logged.
+func OtelProxyWithDebugSampling(rate float64) OtelProxyOption {
+	return func(p *OtelProxy) {
+		p.debugSampleRate = rate
+	}
+}
+
+// Reasons attached to the otel_proxy.spans.rejected metric.
+const (
+	otelProxyRejectBufferFull = "buffer_full"
+	otelProxyRejectUpstream   = "upstream_error"
+	otelProxyRejectCollector  = "collector_rejected"
+	otelProxyRejectSpillFull  = "spill_full"
+)
+
+type otelProxyTelemetry struct {
+	accepted         metric.Int64Counter
+	rejected         metric.Int64Counter
+	forwarded        metric.Int64Counter
+	payloadSize      metric.Int64Histogram
+	upstreamDuration metric.Float64Histogram
+}
+
+func newOtelProxyTelemetry(mp metric.MeterProvider) (*otelProxyTelemetry, error) {
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+	meter := mp.Meter("github.com/pedramktb/go-odj/otel_proxy")
+
+	t := &otelProxyTelemetry{}
+	var err error
+	if t.accepted, err = meter.Int64Counter("otel_proxy.spans.accepted",
+		metric.WithDescription("Spans received from clients and accepted by the proxy."),
+		metric.WithUnit("{span}"),
+	); err != nil {
+		return nil, err
+	}
+	if t.rejected, err = meter.Int64Counter("otel_proxy.spans.rejected",
+		metric.WithDescription("Spans that were accepted from clients but never reached the collector."),
+		metric.WithUnit("{span}"),
+	); err != nil {
+		return nil, err
+	}
+	if t.forwarded, err = meter.Int64Counter("otel_proxy.spans.forwarded",
+		metric.WithDescription("Spans successfully exported to the collector."),
+		metric.WithUnit("{span}"),
+	); err != nil {
+		return nil, err
+	}
+	if t.payloadSize, err = meter.Int64Histogram("otel_proxy.request.body.size",
+		metric.WithDescription("Size of the OTLP/HTTP request bodies received from clients."),
+		metric.WithUnit("By"),
+	); err != nil {
+		return nil, err
+	}
+	if t.upstreamDuration, err = meter.Float64Histogram("otel_proxy.upstream.duration",
+		metric.WithDescription("Duration of single export calls to the collector."),
+		metric.WithUnit("s"),
+	); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *otelProxyTelemetry) reject(ctx context.Context, spans int64, reason string) {
+	if spans > 0 {
+		t.rejected.Add(ctx, spans, metric.WithAttributes(attribute.String("reason", reason)))
+	}
+}
+
+// otelProxyInstrumentedClient records the latency and outcome of every export to the collector.
+type otelProxyInstrumentedClient struct {
+	coltracepb.TraceServiceClient
+	telemetry *otelProxyTelemetry
+}
+
+func (c *otelProxyInstrumentedClient) Export(ctx context.Context, req *coltracepb.ExportTraceServiceRequest, opts ...grpc.CallOption) (*coltracepb.ExportTraceServiceResponse, error) {
+	start := time.Now()
+	resp, err := c.TraceServiceClient.Export(ctx, req, opts...)
+	c.telemetry.upstreamDuration.Record(ctx, time.Since(start).Seconds(),
+		metric.WithAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(status.Code(err)))))
+	if err != nil {
+		return resp, err
+	}
+	rejected := resp.GetPartialSuccess().GetRejectedSpans()
+	c.telemetry.forwarded.Add(ctx, otelProxyCountRequestSpans(req)-rejected)
+	c.telemetry.reject(ctx, rejected, otelProxyRejectCollector)
+	return resp, nil
+}
+
+// logPayloadSummary logs the shape of req at debug level for a sampled fraction of requests.
+func (p *OtelProxy) logPayloadSummary(ctx context.Context, contentType string, size int, req *coltracepb.ExportTraceServiceRequest) {
+	if p.debugSampleRate <= 0 || rand.Float64() >= p.debugSampleRate {
+		return
+	}
+	logger := ctxslog.FromContext(ctx)
+	if !logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+
+	const maxNames = 20
+	var services, names []string
+	for _, rs := range req.GetResourceSpans() {
+		for _, kv := range rs.GetResource().GetAttributes() {
+			if kv.GetKey() == string(semconv.ServiceNameKey) {
+				services = append(services, kv.GetValue().GetStringValue())
+			}
+		}
+		for _, ss := range rs.GetScopeSpans() {
+			for _, span := range ss.GetSpans() {
+				if len(names) < maxNames {
+					names = append(names, span.GetName())
+				}
+			}
+		}
+	}
+
+	logger.DebugContext(ctx, "otel proxy payload",
+		slog.String("content_type", contentType),
+		slog.Int("size", size),
+		slog.Int("resource_spans", len(req.GetResourceSpans())),
+		slog.Int64("spans", otelProxyCountRequestSpans(req)),
+		slog.Any("services", services),
+		slog.Any("span_names", names),
+	)
+}
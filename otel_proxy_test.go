@@ -0,0 +1,98 @@
+package odj
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOtelProxyHTTPStatus(t *testing.T) {
+	tests := []struct {
+		name           string
+		st             *status.Status
+		wantCode       int
+		wantRetryAfter time.Duration
+	}{
+		{name: "resource exhausted with retry info", st: retryInfoStatus(t, codes.ResourceExhausted, 5*time.Second), wantCode: http.StatusTooManyRequests, wantRetryAfter: 5 * time.Second},
+		{name: "resource exhausted without retry info", st: status.New(codes.ResourceExhausted, "quota"), wantCode: http.StatusInternalServerError},
+		{name: "unavailable", st: status.New(codes.Unavailable, ""), wantCode: http.StatusServiceUnavailable},
+		{name: "unavailable with retry info", st: retryInfoStatus(t, codes.Unavailable, time.Second), wantCode: http.StatusServiceUnavailable, wantRetryAfter: time.Second},
+		{name: "canceled", st: status.New(codes.Canceled, ""), wantCode: http.StatusServiceUnavailable},
+		{name: "aborted", st: status.New(codes.Aborted, ""), wantCode: http.StatusServiceUnavailable},
+		{name: "out of range", st: status.New(codes.OutOfRange, ""), wantCode: http.StatusServiceUnavailable},
+		{name: "data loss", st: status.New(codes.DataLoss, ""), wantCode: http.StatusServiceUnavailable},
+		{name: "deadline exceeded", st: status.New(codes.DeadlineExceeded, ""), wantCode: http.StatusGatewayTimeout},
+		{name: "invalid argument", st: status.New(codes.InvalidArgument, ""), wantCode: http.StatusBadRequest},
+		{name: "failed precondition", st: status.New(codes.FailedPrecondition, ""), wantCode: http.StatusBadRequest},
+		{name: "unimplemented", st: status.New(codes.Unimplemented, ""), wantCode: http.StatusNotImplemented},
+		{name: "unauthenticated", st: status.New(codes.Unauthenticated, ""), wantCode: http.StatusInternalServerError},
+		{name: "permission denied", st: status.New(codes.PermissionDenied, ""), wantCode: http.StatusInternalServerError},
+		{name: "unknown", st: status.New(codes.Unknown, ""), wantCode: http.StatusInternalServerError},
+		{name: "invalid argument ignores retry info", st: retryInfoStatus(t, codes.InvalidArgument, time.Second), wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, retryAfter := otelProxyHTTPStatus(tt.st)
+			if code != tt.wantCode {
+				t.Errorf("got status %d, want %d", code, tt.wantCode)
+			}
+			if retryAfter != tt.wantRetryAfter {
+				t.Errorf("got retry after %v, want %v", retryAfter, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestOtelProxyCollectorErrorResponse(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		syncRetry      time.Duration
+		wantCode       int
+		wantRetryAfter string
+		wantCalls      int
+	}{
+		{
+			name:           "throttled",
+			err:            retryInfoStatus(t, codes.ResourceExhausted, 1500*time.Millisecond).Err(),
+			wantCode:       http.StatusTooManyRequests,
+			wantRetryAfter: "2",
+			wantCalls:      1,
+		},
+		{name: "unavailable", err: status.Error(codes.Unavailable, "down"), wantCode: http.StatusServiceUnavailable, wantCalls: 1},
+		{name: "unavailable with sync retry", err: status.Error(codes.Unavailable, "down"), syncRetry: time.Second, wantCode: http.StatusOK, wantCalls: 2},
+		{name: "misconfigured", err: status.Error(codes.Unauthenticated, "bad credentials"), syncRetry: time.Second, wantCode: http.StatusInternalServerError, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeTraceClient{errs: []error{tt.err}}
+			p, _ := newTestOtelProxy(t, client, OtelProxyWithSyncRetry(tt.syncRetry))
+			w := postSpans(t, p, spansRequest("a"))
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("got Retry-After %q, want %q", got, tt.wantRetryAfter)
+			}
+			if client.calls != tt.wantCalls {
+				t.Errorf("got %d exports, want %d", client.calls, tt.wantCalls)
+			}
+			if w.Code == http.StatusOK {
+				return
+			}
+			// Failed requests are answered with the collector's status as OTLP/HTTP requires.
+			var body spb.Status
+			if err := proto.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if st := status.Convert(tt.err); body.GetCode() != int32(st.Code()) || body.GetMessage() != st.Message() {
+				t.Errorf("got status body %d %q, want %d %q", body.GetCode(), body.GetMessage(), st.Code(), st.Message())
+			}
+		})
+	}
+}
@@ -4,29 +4,26 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"hash/fnv"
-	"log/slog"
 	"net/url"
-	"os"
-	"strings"
 	"testing"
-	"time"
 
-	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/pedramktb/go-ctxslog"
 	"github.com/pedramktb/go-typx"
-	postgresC "github.com/testcontainers/testcontainers-go/modules/postgres"
 
 	"github.com/testcontainers/testcontainers-go"
-	"github.com/testcontainers/testcontainers-go/wait"
-	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/codes"
-	"go.opentelemetry.io/otel/trace"
 )
 
-// Postgres establishes a connection pool to a PostgreSQL database using the provided connection parameters and options.
-func Postgres(ctx context.Context, endpoint, db, user, pass string, opts ...typx.KV[string, string]) (*pgxpool.Pool, error) {
+// Postgres establishes a connection pool to a PostgreSQL database using the provided connection parameters.
+// It is NewPostgres with PostgresWithParams(params...).
+func Postgres(ctx context.Context, endpoint, db, user, pass string, params ...typx.KV[string, string]) (*pgxpool.Pool, error) {
+	return NewPostgres(ctx, endpoint, db, user, pass, PostgresWithParams(params...))
+}
+
+// NewPostgres establishes a connection pool to a PostgreSQL database using the provided connection parameters and options.
+// Connections identify themselves with Component as application_name unless configured otherwise.
+// If ctx derives from the context returned by Bootstrap, the pool is closed at shutdown, once the closers registered
+// with the lifecycle, e.g. HTTP servers draining their requests, have finished.
+func NewPostgres(ctx context.Context, endpoint, db, user, pass string, opts ...PostgresOption) (*pgxpool.Pool, error) {
 	if endpoint == "" {
 		return nil, errors.New("database endpoint is required")
 	}
@@ -40,6 +37,11 @@ func Postgres(ctx context.Context, endpoint, db, user, pass string, opts ...typx
 		return nil, errors.New("databbase password is required")
 	}
 
+	var o postgresOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	u := &url.URL{
 		Scheme: "postgres",
 		User:   url.UserPassword(user, pass),
@@ -48,7 +50,7 @@ func Postgres(ctx context.Context, endpoint, db, user, pass string, opts ...typx
 	}
 
 	q := u.Query()
-	for _, kv := range opts {
+	for _, kv := range o.params {
 		q.Set(kv.Key, kv.Val)
 	}
 	u.RawQuery = q.Encode()
@@ -57,7 +59,15 @@ func Postgres(ctx context.Context, endpoint, db, user, pass string, opts ...typx
 	if err != nil {
 		return nil, err
 	}
-	config.ConnConfig.Tracer = &queryTracer{}
+	metrics, err := newPgMetrics(o.meterProvider)
+	if err != nil {
+		return nil, err
+	}
+	tracer := newPgTracer(&o, metrics)
+	config.ConnConfig.Tracer = tracer
+	if err := o.apply(config); err != nil {
+		return nil, err
+	}
 
 	pool, err := pgxpool.NewWithConfig(ctx, config)
 	if err != nil {
@@ -65,92 +75,52 @@ func Postgres(ctx context.Context, endpoint, db, user, pass string, opts ...typx
 	}
 
 	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
 		return nil, err
 	}
 
-	return pool, nil
-}
-
-// RunWithPgLock returns a function that executes the provided function within a PostgreSQL advisory lock.
-// The lock is identified by a hash of the given name,ensuring that only one instance of the function can run concurrently
-// across different processes or threads that use the same lock name. If the lock cannot be acquired,
-// the function will log a message and return without executing the provided function.
-func RunWithPgLock(ctx context.Context, db *pgxpool.Pool, name string, fn func(ctx context.Context)) func() error {
-	h := fnv.New64a()
-	_, _ = h.Write([]byte(name))
-	lockID := int64(h.Sum64())
-	return func() error {
-		tx, err := db.Begin(ctx)
-		if err != nil {
-			return fmt.Errorf("failed to begin tx for function lock %s: %w", name, err)
-		}
-		defer func() { _ = tx.Rollback(ctx) }()
-
-		var acquired bool
-		if err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock($1)", lockID).Scan(&acquired); err != nil {
-			return fmt.Errorf("failed to acquire advisory lock for function %s: %w", name, err)
+	for _, fn := range o.startup {
+		if err := fn(ctx, pool); err != nil {
+			pool.Close()
+			return nil, err
 		}
+	}
 
-		if !acquired {
-			ctxslog.FromContext(ctx).InfoContext(ctx, "skipping function, lock not acquired", slog.String("function", name))
-			return nil
-		}
+	if tracer.slow != nil {
+		tracer.slow.pool.Store(pool)
+	}
 
-		fn(ctx)
+	registration, err := metrics.observe(pool)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
 
-		if err := tx.Commit(ctx); err != nil {
-			return fmt.Errorf("failed to commit tx for function lock %s: %w", name, err)
+	onShutdown(ctx, func(context.Context) error {
+		pool.Close()
+		if err := registration.Unregister(); err != nil {
+			return fmt.Errorf("failed to unregister postgres pool metrics: %w", err)
 		}
-
 		return nil
-	}
-}
-
-type queryTracer struct{}
-
-func (*queryTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
-	if span := trace.SpanFromContext(ctx); span.IsRecording() {
-		span.SetAttributes(
-			attribute.String("query.statement", data.SQL),
-			attribute.Int("query.arg_count", len(data.Args)),
-		)
-	}
-	return ctx
-}
+	})
 
-func (*queryTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
-	span := trace.SpanFromContext(ctx)
-	if !span.IsRecording() {
-		return
-	}
-	span.SetAttributes(
-		attribute.String("query.command_tag", data.CommandTag.String()),
-		attribute.Int64("query.rows_affected", data.CommandTag.RowsAffected()),
-	)
-	if data.Err != nil {
-		span.RecordError(data.Err)
-		span.SetStatus(codes.Error, data.Err.Error())
-	}
+	return pool, nil
 }
 
 // PostgresTestContainer starts a new Postgres test container with the specified options and returns the container instance.
-// It sets the timezone to UTC and waits for the database system to be ready before returning.
+// Every option is a postgresql.conf setting, as set by PostgresContainerWithSetting.
+// It sets the timezone to UTC and waits for the database system to be ready before returning. It panics on errors,
+// see StartPostgresTestContainer and RunPostgresTestContainer for variants returning them and taking typed options.
 func PostgresTestContainer(ctx context.Context, opts ...typx.KV[string, string]) (container testcontainers.Container) {
-	_ = os.Setenv("TZ", "UTC")
-
-	postgresContainer, err := postgresC.Run(ctx, "postgres:18.1",
-		postgresC.WithUsername("test"),
-		postgresC.WithPassword("test"),
-		testcontainers.WithWaitStrategy(
-			wait.ForLog("database system is ready to accept connections").
-				WithOccurrence(2).
-				WithStartupTimeout(time.Minute)),
-	)
+	containerOpts := make([]PostgresContainerOption, 0, len(opts))
+	for _, kv := range opts {
+		containerOpts = append(containerOpts, PostgresContainerWithSetting(kv.Key, kv.Val))
+	}
+	container, _, err := RunPostgresTestContainer(ctx, containerOpts...)
 	if err != nil {
 		panic(err)
 	}
-
-	return postgresContainer
+	return container
 }
 
 func postgresTestContainerConnection(ctx context.Context, container testcontainers.Container, dbName string, opts ...typx.KV[string, string]) (db *pgxpool.Pool) {
@@ -192,6 +162,9 @@ func postgresTestContainerConnection(ctx context.Context, container testcontaine
 // executes the CREATE DATABASE command, and then returns a new connection pool to the newly created database.
 func PostgresTestContainerCreateDB(ctx context.Context, container testcontainers.Container, name string, opts ...typx.KV[string, string]) *pgxpool.Pool {
 	pool := postgresTestContainerConnection(ctx, container, "postgres", opts...)
+	if err := postgresTestDBRegister(ctx, pool, name); err != nil {
+		panic(err)
+	}
 	_, err := pool.Exec(ctx, fmt.Sprintf("CREATE DATABASE %q", name))
 	if err != nil {
 		panic(err)
@@ -206,15 +179,17 @@ func PostgresTestContainerCreateDB(ctx context.Context, container testcontainers
 func PostgresTestContainerDropDB(ctx context.Context, container testcontainers.Container, name string, pool *pgxpool.Pool, opts ...typx.KV[string, string]) {
 	pool.Close()
 	pool = postgresTestContainerConnection(ctx, container, "postgres", opts...)
-	_, _ = pool.Exec(ctx, fmt.Sprintf("DROP DATABASE %q WITH (force)", name))
+	if _, err := pool.Exec(ctx, fmt.Sprintf("DROP DATABASE %q WITH (force)", name)); err == nil {
+		postgresTestDBUnregister(ctx, pool, name)
+	}
 	pool.Close()
 }
 
 // PostgresTestContainerSetupDB creates a new database in the given Postgres test container with a name derived from the test name,
-// and returns a connection pool to that database. It also registers a cleanup function to drop the database after the test completes.
+// which is unique even for long test names and across concurrent test runs, and returns a connection pool to that database. It also registers a cleanup function to drop the database after the test completes.
 func PostgresTestContainerSetupDB(ctx context.Context, t *testing.T, container testcontainers.Container, opts ...typx.KV[string, string]) *pgxpool.Pool {
 	t.Helper()
-	name := strings.ToLower(strings.ReplaceAll(t.Name(), "/", "_"))
+	name := postgresTestDBName(t)
 	pool := PostgresTestContainerCreateDB(ctx, container, name, opts...)
 	t.Cleanup(func() {
 		PostgresTestContainerDropDB(ctx, container, name, pool, opts...)
@@ -0,0 +1,184 @@
+package odj
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pedramktb/go-ctxslog"
+)
+
+// LeaderElectorOption configures a LeaderElector.
+type LeaderElectorOption func(*LeaderElector)
+
+// LeaderElectorOnElected sets the function called when this instance becomes the leader.
+// Its context is cancelled when leadership is lost or the elector stops, and the function should return soon after.
+// It runs in its own goroutine, so it may block for as long as it leads, e.g. to run a singleton worker.
+func LeaderElectorOnElected(fn func(ctx context.Context)) LeaderElectorOption {
+	return func(l *LeaderElector) {
+		l.onElected = fn
+	}
+}
+
+// LeaderElectorOnRevoked sets the function called after leadership was lost or given up
+// and the function passed to LeaderElectorOnElected has returned.
+func LeaderElectorOnRevoked(fn func()) LeaderElectorOption {
+	return func(l *LeaderElector) {
+		l.onRevoked = fn
+	}
+}
+
+// LeaderElectorWithInterval sets how often a follower tries to acquire the lock and a leader checks its connection.
+// It bounds how long two instances may both act as leader after a leader's connection silently broke. Defaults to 5s.
+func LeaderElectorWithInterval(d time.Duration) LeaderElectorOption {
+	return func(l *LeaderElector) {
+		if d > 0 {
+			l.interval = d
+		}
+	}
+}
+
+// LeaderElector elects a single leader among all instances using the same name, by holding a session-level
+// advisory lock on a dedicated connection. Unlike RunWithPgLock it keeps no transaction open, so it is suited to
+// long-running singleton workers.
+type LeaderElector struct {
+	pool      *pgxpool.Pool
+	name      string
+	lockID    int64
+	interval  time.Duration
+	onElected func(ctx context.Context)
+	onRevoked func()
+
+	conn   *pgx.Conn
+	leader atomic.Bool
+	done   chan struct{}
+}
+
+// NewLeaderElector starts campaigning for the leadership of name in the background until ctx is cancelled.
+// Then the leader steps down and releases the lock so another instance can take over right away.
+// If ctx derives from the context returned by Bootstrap, shutdown waits for the function passed to
+// LeaderElectorOnElected to return and the lock to be released, before Postgres pools are closed.
+func NewLeaderElector(ctx context.Context, pool *pgxpool.Pool, name string, opts ...LeaderElectorOption) *LeaderElector {
+	l := &LeaderElector{
+		pool:     pool,
+		name:     name,
+		lockID:   pgLockID(name),
+		interval: 5 * time.Second,
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	go l.run(ctx)
+	onShutdown(ctx, func(ctx context.Context) error {
+		select {
+		case <-l.done:
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("leader election %s did not step down in time: %w", name, ctx.Err())
+		}
+	})
+	return l
+}
+
+// IsLeader reports whether this instance currently holds the leadership.
+func (l *LeaderElector) IsLeader() bool {
+	return l.leader.Load()
+}
+
+// Done is closed once the elector has stopped and released the lock after its context was cancelled.
+func (l *LeaderElector) Done() <-chan struct{} {
+	return l.done
+}
+
+func (l *LeaderElector) run(ctx context.Context) {
+	defer close(l.done)
+	defer l.disconnect()
+
+	logger := ctxslog.FromContext(ctx).With(slog.String("leader_election", l.name))
+	for {
+		if elected, err := l.campaign(ctx); err != nil {
+			logger.WarnContext(ctx, "failed to campaign for leadership", slog.Any("err", err))
+			l.disconnect()
+		} else if elected {
+			logger.InfoContext(ctx, "elected leader")
+			l.lead(ctx)
+			if ctx.Err() != nil {
+				logger.InfoContext(ctx, "stepped down as leader")
+				return
+			}
+			logger.WarnContext(ctx, "lost leadership")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(l.interval):
+		}
+	}
+}
+
+// campaign tries once to acquire the lock, connecting first if needed.
+func (l *LeaderElector) campaign(ctx context.Context) (bool, error) {
+	if l.conn == nil {
+		conn, err := l.pool.Acquire(ctx)
+		if err != nil {
+			return false, fmt.Errorf("failed to acquire connection for leader election %s: %w", l.name, err)
+		}
+		// The session lock lives as long as the connection, which must therefore not be returned to the pool.
+		l.conn = conn.Hijack()
+	}
+
+	var acquired bool
+	if err := l.conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", l.lockID).Scan(&acquired); err != nil {
+		return false, fmt.Errorf("failed to try advisory lock for leader election %s: %w", l.name, err)
+	}
+	return acquired, nil
+}
+
+// lead runs the elected callback and monitors the connection until it breaks or ctx is cancelled.
+// The lock is released by closing the connection, after the callback has returned.
+func (l *LeaderElector) lead(ctx context.Context) {
+	l.leader.Store(true)
+	leaderCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	if l.onElected != nil {
+		wg.Go(func() { l.onElected(leaderCtx) })
+	}
+
+	ticker := time.NewTicker(l.interval)
+	for alive := true; alive; {
+		select {
+		case <-ctx.Done():
+			alive = false
+		case <-ticker.C:
+			pingCtx, cancelPing := context.WithTimeout(ctx, l.interval)
+			alive = l.conn.Ping(pingCtx) == nil
+			cancelPing()
+		}
+	}
+	ticker.Stop()
+
+	l.leader.Store(false)
+	cancel()
+	wg.Wait()
+	l.disconnect()
+	if l.onRevoked != nil {
+		l.onRevoked()
+	}
+}
+
+func (l *LeaderElector) disconnect() {
+	if l.conn == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), l.interval)
+	defer cancel()
+	_ = l.conn.Close(ctx)
+	l.conn = nil
+}
@@ -0,0 +1,158 @@
+package odj
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pedramktb/go-ctxslog"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// PgLockOption configures how RunWithPgLock acquires its lock.
+type PgLockOption func(*pgLockOptions)
+
+type pgLockOptions struct {
+	wait    bool
+	timeout time.Duration
+}
+
+// PgLockTry tries to acquire the lock once and skips the function if it is held elsewhere. This is the default.
+func PgLockTry() PgLockOption {
+	return func(o *pgLockOptions) {
+		o.wait = false
+		o.timeout = 0
+	}
+}
+
+// PgLockWait waits until the lock is free, e.g. for migrations and one-time backfills that must run exactly once.
+// The wait ends early only if the context is cancelled.
+func PgLockWait() PgLockOption {
+	return func(o *pgLockOptions) {
+		o.wait = true
+		o.timeout = 0
+	}
+}
+
+// PgLockWaitTimeout waits up to timeout for the lock, using lock_timeout, and skips the function if it is still held.
+// A timeout of zero or less does not wait at all, like PgLockTry.
+func PgLockWaitTimeout(timeout time.Duration) PgLockOption {
+	return func(o *pgLockOptions) {
+		if timeout <= 0 {
+			PgLockTry()(o)
+			return
+		}
+		o.wait = true
+		o.timeout = timeout
+	}
+}
+
+// pgLockID derives the advisory lock key of name.
+func pgLockID(name string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// RunWithPgLock returns a function that executes the provided function within a PostgreSQL advisory lock.
+// The lock is identified by a hash of the given name,ensuring that only one instance of the function can run concurrently
+// across different processes or threads that use the same lock name. By default, if the lock cannot be acquired,
+// the function will log a message and return without executing the provided function. See PgLockWait and PgLockWaitTimeout to wait instead.
+// The context passed to fn carries the lock's transaction, so statements run through a Querier or InTx join it.
+func RunWithPgLock(ctx context.Context, db *pgxpool.Pool, name string, fn func(ctx context.Context), opts ...PgLockOption) func() error {
+	run := RunWithPgLockResult(ctx, db, name, fn, opts...)
+	return func() error {
+		_, err := run()
+		return err
+	}
+}
+
+// RunWithPgLockResult is like RunWithPgLock, but the returned function also reports whether fn ran,
+// so callers can tell a skipped run from a successful one.
+func RunWithPgLockResult(ctx context.Context, db *pgxpool.Pool, name string, fn func(ctx context.Context), opts ...PgLockOption) func() (bool, error) {
+	return runWithPgLock(ctx, db, name, func(ctx context.Context) error {
+		fn(ctx)
+		return nil
+	}, opts...)
+}
+
+// RunWithPgLockErr is like RunWithPgLockResult, but if fn returns an error, the lock's transaction is rolled back
+// and the error is returned. A panic in fn is recovered and returned as an internal tagerr error with the stack
+// trace of the panic, which is also recorded on the span of the run.
+func RunWithPgLockErr(ctx context.Context, db *pgxpool.Pool, name string, fn func(ctx context.Context) error, opts ...PgLockOption) func() (bool, error) {
+	return runWithPgLock(ctx, db, name, func(ctx context.Context) (err error) {
+		defer recoverAsErr(ctx, slog.String("function", name), &err)
+		return fn(ctx)
+	}, opts...)
+}
+
+// runWithPgLock implements the RunWithPgLock functions. A panic in fn propagates after the transaction was rolled back.
+func runWithPgLock(ctx context.Context, db *pgxpool.Pool, name string, fn func(ctx context.Context) error, opts ...PgLockOption) func() (bool, error) {
+	var o pgLockOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	lockID := pgLockID(name)
+	return func() (ran bool, err error) {
+		ctx, span := pgStartSpan(ctx, db, "lock "+name, attribute.String("db.advisory_lock.name", name))
+		defer func() {
+			span.SetAttributes(attribute.Bool("db.advisory_lock.ran", ran))
+			pgEndSpan(span, err)
+		}()
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			return false, fmt.Errorf("failed to begin tx for function lock %s: %w", name, err)
+		}
+		defer func() { _ = tx.Rollback(ctx) }()
+
+		acquired := true
+		switch {
+		case !o.wait:
+			if err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock($1)", lockID).Scan(&acquired); err != nil {
+				return false, fmt.Errorf("failed to acquire advisory lock for function %s: %w", name, err)
+			}
+		case o.timeout > 0:
+			if _, err := tx.Exec(ctx, "SELECT set_config('lock_timeout', $1, true)", strconv.FormatInt(max(o.timeout.Milliseconds(), 1), 10)); err != nil {
+				return false, fmt.Errorf("failed to set lock timeout for function %s: %w", name, err)
+			}
+			_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", lockID)
+			var pgErr *pgconn.PgError
+			switch {
+			case errors.As(err, &pgErr) && pgErr.Code == "55P03": // lock_not_available
+				acquired = false
+			case err != nil:
+				return false, fmt.Errorf("failed to acquire advisory lock for function %s: %w", name, err)
+			default:
+				if _, err := tx.Exec(ctx, "SET LOCAL lock_timeout TO DEFAULT"); err != nil {
+					return false, fmt.Errorf("failed to reset lock timeout for function %s: %w", name, err)
+				}
+			}
+		default:
+			if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", lockID); err != nil {
+				return false, fmt.Errorf("failed to acquire advisory lock for function %s: %w", name, err)
+			}
+		}
+
+		if !acquired {
+			ctxslog.FromContext(ctx).InfoContext(ctx, "skipping function, lock not acquired", slog.String("function", name))
+			return false, nil
+		}
+
+		if err := fn(ContextWithTx(ctx, tx)); err != nil {
+			return true, err
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			return true, fmt.Errorf("failed to commit tx for function lock %s: %w", name, err)
+		}
+
+		return true, nil
+	}
+}
@@ -0,0 +1,34 @@
+package odj
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPgLockOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []PgLockOption
+		want pgLockOptions
+	}{
+		{name: "default tries", want: pgLockOptions{}},
+		{name: "try", opts: []PgLockOption{PgLockTry()}, want: pgLockOptions{}},
+		{name: "wait", opts: []PgLockOption{PgLockWait()}, want: pgLockOptions{wait: true}},
+		{name: "wait timeout", opts: []PgLockOption{PgLockWaitTimeout(time.Second)}, want: pgLockOptions{wait: true, timeout: time.Second}},
+		{name: "zero wait timeout tries", opts: []PgLockOption{PgLockWaitTimeout(0)}, want: pgLockOptions{}},
+		{name: "negative wait timeout tries", opts: []PgLockOption{PgLockWaitTimeout(-time.Second)}, want: pgLockOptions{}},
+		{name: "zero wait timeout overrides wait", opts: []PgLockOption{PgLockWait(), PgLockWaitTimeout(0)}, want: pgLockOptions{}},
+		{name: "last option wins", opts: []PgLockOption{PgLockWaitTimeout(time.Second), PgLockWait()}, want: pgLockOptions{wait: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got pgLockOptions
+			for _, opt := range tt.opts {
+				opt(&got)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package odj
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+// PostgresWithMeterProvider sets the meter provider used for the pool and query metrics.
+// Defaults to the global meter provider.
+func PostgresWithMeterProvider(mp metric.MeterProvider) PostgresOption {
+	return func(o *postgresOptions) {
+		o.meterProvider = mp
+	}
+}
+
+// pgMetrics records the database client metrics of a pgx connection pool.
+type pgMetrics struct {
+	duration metric.Float64Histogram
+	errors   metric.Int64Counter
+
+	connections  metric.Int64ObservableUpDownCounter
+	maxConns     metric.Int64ObservableUpDownCounter
+	constructing metric.Int64ObservableUpDownCounter
+	waitCount    metric.Int64ObservableCounter
+	waitDuration metric.Float64ObservableCounter
+	meter        metric.Meter
+}
+
+func newPgMetrics(mp metric.MeterProvider) (*pgMetrics, error) {
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+	meter := mp.Meter("github.com/pedramktb/go-odj/postgres")
+
+	m := &pgMetrics{meter: meter}
+	var err error
+	if m.duration, err = meter.Float64Histogram("db.client.operation.duration",
+		metric.WithDescription("Duration of database client operations."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10),
+	); err != nil {
+		return nil, err
+	}
+	if m.errors, err = meter.Int64Counter("db.client.operation.errors",
+		metric.WithDescription("Database client operations that failed."),
+		metric.WithUnit("{operation}"),
+	); err != nil {
+		return nil, err
+	}
+	if m.connections, err = meter.Int64ObservableUpDownCounter("db.client.connection.count",
+		metric.WithDescription("The number of connections that are currently in the state described by the state attribute."),
+		metric.WithUnit("{connection}"),
+	); err != nil {
+		return nil, err
+	}
+	if m.maxConns, err = meter.Int64ObservableUpDownCounter("db.client.connection.max",
+		metric.WithDescription("The maximum number of open connections allowed."),
+		metric.WithUnit("{connection}"),
+	); err != nil {
+		return nil, err
+	}
+	if m.constructing, err = meter.Int64ObservableUpDownCounter("db.client.connection.constructing",
+		metric.WithDescription("The number of connections that are currently being established."),
+		metric.WithUnit("{connection}"),
+	); err != nil {
+		return nil, err
+	}
+	if m.waitCount, err = meter.Int64ObservableCounter("db.client.connection.wait.count",
+		metric.WithDescription("The number of acquires that had to wait for a connection because the pool was empty."),
+		metric.WithUnit("{acquire}"),
+	); err != nil {
+		return nil, err
+	}
+	if m.waitDuration, err = meter.Float64ObservableCounter("db.client.connection.wait.duration",
+		metric.WithDescription("The total time acquires spent waiting for a connection because the pool was empty."),
+		metric.WithUnit("s"),
+	); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// observe reports the statistics of pool on every collection until the returned registration is unregistered.
+func (m *pgMetrics) observe(pool *pgxpool.Pool) (metric.Registration, error) {
+	cfg := pool.Config().ConnConfig
+	poolAttrs := metric.WithAttributes(
+		semconv.DBSystemNamePostgreSQL,
+		semconv.DBClientConnectionPoolName(cfg.Host+"/"+cfg.Database),
+	)
+	return m.meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		stat := pool.Stat()
+		o.ObserveInt64(m.connections, int64(stat.IdleConns()), poolAttrs, metric.WithAttributes(semconv.DBClientConnectionStateIdle))
+		o.ObserveInt64(m.connections, int64(stat.AcquiredConns()), poolAttrs, metric.WithAttributes(semconv.DBClientConnectionStateUsed))
+		o.ObserveInt64(m.maxConns, int64(stat.MaxConns()), poolAttrs)
+		o.ObserveInt64(m.constructing, int64(stat.ConstructingConns()), poolAttrs)
+		o.ObserveInt64(m.waitCount, stat.EmptyAcquireCount(), poolAttrs)
+		o.ObserveFloat64(m.waitDuration, stat.EmptyAcquireWaitTime().Seconds(), poolAttrs)
+		return nil
+	}, m.connections, m.maxConns, m.constructing, m.waitCount, m.waitDuration)
+}
+
+// record records the duration and outcome of an operation started at start.
+func (m *pgMetrics) record(ctx context.Context, start time.Time, cfg *pgconn.Config, op, collection string, err error) {
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemNamePostgreSQL,
+		semconv.DBNamespace(cfg.Database),
+		semconv.ServerAddress(cfg.Host),
+		semconv.ServerPort(int(cfg.Port)),
+	}
+	if op != "" {
+		attrs = append(attrs, semconv.DBOperationName(op))
+	}
+	if collection != "" {
+		attrs = append(attrs, semconv.DBCollectionName(collection))
+	}
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			attrs = append(attrs, semconv.DBResponseStatusCode(pgErr.Code), semconv.ErrorTypeKey.String(pgErr.Code))
+		} else {
+			attrs = append(attrs, semconv.ErrorType(err))
+		}
+	}
+
+	set := metric.WithAttributes(attrs...)
+	m.duration.Record(ctx, time.Since(start).Seconds(), set)
+	if err != nil {
+		m.errors.Add(ctx, 1, set)
+	}
+}
+
+// pgCollectionName returns the table a statement operates on, i.e. the first name after FROM, INTO, UPDATE or TABLE,
+// or an empty string if there is none. Statements reading several tables are attributed to the first one.
+func pgCollectionName(sql string) string {
+	fields := strings.FieldsFunc(pgNormalizeSQL(sql), func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\r' || r == '\n' || r == '(' || r == ')' || r == ',' || r == ';'
+	})
+	for i := 0; i+1 < len(fields); i++ {
+		switch strings.ToUpper(fields[i]) {
+		case "FROM", "INTO", "UPDATE", "TABLE", "JOIN":
+			name := fields[i+1]
+			if strings.EqualFold(name, "ONLY") && i+2 < len(fields) {
+				name = fields[i+2]
+			}
+			if pgIsName(name) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// pgIsName reports whether s is a possibly schema-qualified and quoted name, as opposed to e.g. a subquery or function.
+func pgIsName(s string) bool {
+	if s == "" || s == "?" || strings.HasPrefix(s, "$") {
+		return false
+	}
+	for _, part := range strings.Split(s, ".") {
+		if len(part) >= 2 && part[0] == '"' && part[len(part)-1] == '"' {
+			continue
+		}
+		if part == "" || part[0] >= '0' && part[0] <= '9' {
+			return false
+		}
+		for i := 0; i < len(part); i++ {
+			if !pgIdentByte(part[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
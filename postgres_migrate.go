@@ -0,0 +1,208 @@
+package odj
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pedramktb/go-ctxslog"
+)
+
+// MigrateOption configures Migrate.
+type MigrateOption func(*migrateOptions)
+
+type migrateOptions struct {
+	table    string
+	baseline int64
+}
+
+// MigrateWithTable sets the table, optionally schema qualified, in which applied migrations are recorded.
+// Defaults to "odj_schema_history".
+func MigrateWithTable(table string) MigrateOption {
+	return func(o *migrateOptions) {
+		o.table = table
+	}
+}
+
+// MigrateWithBaseline adopts an existing database: if no migration was recorded yet, all migrations up to and
+// including version are recorded as applied without running them, and only later ones are applied.
+func MigrateWithBaseline(version int64) MigrateOption {
+	return func(o *migrateOptions) {
+		o.baseline = version
+	}
+}
+
+// PostgresWithMigrations applies the migrations in fsys with Migrate when the pool is created, so the application
+// only starts on an up-to-date schema.
+func PostgresWithMigrations(fsys fs.FS, opts ...MigrateOption) PostgresOption {
+	return func(o *postgresOptions) {
+		o.startup = append(o.startup, func(ctx context.Context, pool *pgxpool.Pool) error {
+			return Migrate(ctx, pool, fsys, opts...)
+		})
+	}
+}
+
+type migration struct {
+	version     int64
+	description string
+	file        string
+	checksum    string
+	sql         string
+}
+
+// Migrate applies the versioned .sql files at the root of fsys, e.g. an embed.FS narrowed with fs.Sub,
+// that have not been applied yet and records them in a schema history table.
+// Files are named after their version and a description, e.g. "0001_create_users.sql", and applied in version order.
+//
+// Migrations only go up: files ending in ".down.sql" are ignored, and a pending migration older than the latest
+// applied one is an error. The checksum of every applied migration is compared with its file to detect edited
+// migrations. All pending migrations are applied in one transaction under an advisory lock, so concurrently starting
+// replicas wait for each other and a failed migration leaves the schema unchanged. Statements that cannot run in
+// a transaction, such as CREATE INDEX CONCURRENTLY, are therefore not supported.
+func Migrate(ctx context.Context, pool *pgxpool.Pool, fsys fs.FS, opts ...MigrateOption) error {
+	o := migrateOptions{table: "odj_schema_history"}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	migrations, err := loadMigrations(fsys)
+	if err != nil {
+		return err
+	}
+
+	_, err = RunWithPgLockErr(ctx, pool, "odj-migrate:"+o.table, func(ctx context.Context) error {
+		tx, _ := TxFromContext(ctx)
+		return o.migrate(ctx, tx, migrations)
+	}, PgLockWait())()
+	return err
+}
+
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	var migrations []migration
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || path.Ext(name) != ".sql" || strings.HasSuffix(name, ".down.sql") {
+			continue
+		}
+
+		digits := len(name) - len(strings.TrimLeft(name, "0123456789"))
+		if digits == 0 {
+			return nil, fmt.Errorf("migration %s must start with a version number", name)
+		}
+		version, err := strconv.ParseInt(name[:digits], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version of migration %s: %w", name, err)
+		}
+
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", name, err)
+		}
+		sum := sha256.Sum256(content)
+
+		migrations = append(migrations, migration{
+			version:     version,
+			description: strings.ReplaceAll(strings.Trim(strings.TrimSuffix(name[digits:], ".sql"), "_-"), "_", " "),
+			file:        name,
+			checksum:    hex.EncodeToString(sum[:]),
+			sql:         string(content),
+		})
+	}
+
+	slices.SortFunc(migrations, func(a, b migration) int { return cmp.Compare(a.version, b.version) })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", migrations[i-1].file, migrations[i].file)
+		}
+	}
+	return migrations, nil
+}
+
+func (o migrateOptions) migrate(ctx context.Context, tx pgx.Tx, migrations []migration) error {
+	logger := ctxslog.FromContext(ctx)
+	table := pgx.Identifier(strings.Split(o.table, ".")).Sanitize()
+
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	version bigint PRIMARY KEY,
+	description text NOT NULL,
+	checksum text NOT NULL,
+	baseline boolean NOT NULL DEFAULT false,
+	applied_at timestamptz NOT NULL DEFAULT now(),
+	execution_ms bigint NOT NULL
+)`, table)); err != nil {
+		return fmt.Errorf("failed to create schema history table: %w", err)
+	}
+
+	rows, err := tx.Query(ctx, fmt.Sprintf("SELECT version, checksum FROM %s", table))
+	if err != nil {
+		return fmt.Errorf("failed to read schema history: %w", err)
+	}
+	applied := make(map[int64]string)
+	var latest, version int64
+	var checksum string
+	if _, err := pgx.ForEachRow(rows, []any{&version, &checksum}, func() error {
+		applied[version] = checksum
+		latest = max(latest, version)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to read schema history: %w", err)
+	}
+
+	insert := fmt.Sprintf("INSERT INTO %s (version, description, checksum, baseline, execution_ms) VALUES ($1, $2, $3, $4, $5)", table)
+	if len(applied) == 0 && o.baseline > 0 {
+		for _, m := range migrations {
+			if m.version > o.baseline {
+				break
+			}
+			if _, err := tx.Exec(ctx, insert, m.version, m.description, m.checksum, true, 0); err != nil {
+				return fmt.Errorf("failed to record baseline migration %s: %w", m.file, err)
+			}
+			applied[m.version] = m.checksum
+			latest = m.version
+		}
+		logger.InfoContext(ctx, "baselined schema", slog.Int64("version", o.baseline))
+	}
+
+	var pending []migration
+	for _, m := range migrations {
+		checksum, ok := applied[m.version]
+		switch {
+		case ok && checksum != m.checksum:
+			return fmt.Errorf("migration %s was edited after it was applied, its checksum changed from %s to %s", m.file, checksum, m.checksum)
+		case ok:
+		case m.version < latest:
+			return fmt.Errorf("migration %s is older than the latest applied migration %d", m.file, latest)
+		default:
+			pending = append(pending, m)
+		}
+	}
+
+	for _, m := range pending {
+		start := time.Now()
+		if _, err := tx.Exec(ctx, m.sql); err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", m.file, err)
+		}
+		duration := time.Since(start)
+		if _, err := tx.Exec(ctx, insert, m.version, m.description, m.checksum, false, duration.Milliseconds()); err != nil {
+			return fmt.Errorf("failed to record migration %s: %w", m.file, err)
+		}
+		logger.InfoContext(ctx, "applied migration", slog.String("migration", m.file), slog.Duration("duration", duration))
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package odj
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pedramktb/go-typx"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PostgresOption configures the connection pool created by Postgres.
+type PostgresOption func(*postgresOptions)
+
+type postgresOptions struct {
+	params                []typx.KV[string, string]
+	runtimeParams         map[string]string
+	afterConnect          []func(ctx context.Context, conn *pgx.Conn) error
+	pool                  []func(config *pgxpool.Config)
+	tracerProvider        trace.TracerProvider
+	rootSpans             bool
+	meterProvider         metric.MeterProvider
+	statementPolicy       PostgresStatementPolicy
+	maxStatementLength    int
+	slowQueryThreshold    time.Duration
+	slowQueryExplainAfter int
+	startup               []func(ctx context.Context, pool *pgxpool.Pool) error
+	errs                  []error
+}
+
+func (o *postgresOptions) err(err error) {
+	o.errs = append(o.errs, err)
+}
+
+// PostgresWithParams adds raw connection string parameters, e.g. sslmode or pool_max_conns.
+// Prefer the typed options where one exists.
+func PostgresWithParams(params ...typx.KV[string, string]) PostgresOption {
+	return func(o *postgresOptions) {
+		o.params = append(o.params, params...)
+	}
+}
+
+// PostgresWithMaxConns sets the maximum size of the pool. Defaults to the greater of 4 or the number of CPUs.
+func PostgresWithMaxConns(n int32) PostgresOption {
+	return func(o *postgresOptions) {
+		if n < 1 {
+			o.err(fmt.Errorf("postgres max conns must be at least 1, got %d", n))
+			return
+		}
+		o.pool = append(o.pool, func(c *pgxpool.Config) { c.MaxConns = n })
+	}
+}
+
+// PostgresWithMinConns sets the number of connections the pool keeps open at all times.
+func PostgresWithMinConns(n int32) PostgresOption {
+	return func(o *postgresOptions) {
+		if n < 0 {
+			o.err(fmt.Errorf("postgres min conns must not be negative, got %d", n))
+			return
+		}
+		o.pool = append(o.pool, func(c *pgxpool.Config) { c.MinConns = n })
+	}
+}
+
+// PostgresWithMinIdleConns sets the number of idle connections the pool tries to keep ready.
+func PostgresWithMinIdleConns(n int32) PostgresOption {
+	return func(o *postgresOptions) {
+		if n < 0 {
+			o.err(fmt.Errorf("postgres min idle conns must not be negative, got %d", n))
+			return
+		}
+		o.pool = append(o.pool, func(c *pgxpool.Config) { c.MinIdleConns = n })
+	}
+}
+
+// PostgresWithMaxConnLifetime sets how long a connection may live before it is closed and replaced.
+// A jitter spreads the replacement of connections that were opened together.
+func PostgresWithMaxConnLifetime(lifetime, jitter time.Duration) PostgresOption {
+	return func(o *postgresOptions) {
+		if lifetime <= 0 || jitter < 0 {
+			o.err(fmt.Errorf("postgres max conn lifetime must be positive and its jitter not negative, got %s and %s", lifetime, jitter))
+			return
+		}
+		o.pool = append(o.pool, func(c *pgxpool.Config) {
+			c.MaxConnLifetime = lifetime
+			c.MaxConnLifetimeJitter = jitter
+		})
+	}
+}
+
+// PostgresWithMaxConnIdleTime sets how long a connection may stay idle before it is closed.
+func PostgresWithMaxConnIdleTime(d time.Duration) PostgresOption {
+	return func(o *postgresOptions) {
+		if d <= 0 {
+			o.err(fmt.Errorf("postgres max conn idle time must be positive, got %s", d))
+			return
+		}
+		o.pool = append(o.pool, func(c *pgxpool.Config) { c.MaxConnIdleTime = d })
+	}
+}
+
+// PostgresWithHealthCheckPeriod sets how often idle connections are checked.
+func PostgresWithHealthCheckPeriod(d time.Duration) PostgresOption {
+	return func(o *postgresOptions) {
+		if d <= 0 {
+			o.err(fmt.Errorf("postgres health check period must be positive, got %s", d))
+			return
+		}
+		o.pool = append(o.pool, func(c *pgxpool.Config) { c.HealthCheckPeriod = d })
+	}
+}
+
+// PostgresWithRuntimeParam sets a server run-time parameter on every new connection, e.g. "timezone" to "UTC".
+// Run-time parameters are sent with the startup message and do not cost an extra round trip.
+func PostgresWithRuntimeParam(name, value string) PostgresOption {
+	return func(o *postgresOptions) {
+		if o.runtimeParams == nil {
+			o.runtimeParams = make(map[string]string)
+		}
+		o.runtimeParams[name] = value
+	}
+}
+
+// PostgresWithSearchPath sets the search_path of every new connection.
+func PostgresWithSearchPath(schemas ...string) PostgresOption {
+	quoted := make([]string, 0, len(schemas))
+	for _, schema := range schemas {
+		quoted = append(quoted, pgx.Identifier{schema}.Sanitize())
+	}
+	return PostgresWithRuntimeParam("search_path", strings.Join(quoted, ", "))
+}
+
+// PostgresWithStatementTimeout aborts statements of every new connection that run longer than d.
+func PostgresWithStatementTimeout(d time.Duration) PostgresOption {
+	return PostgresWithRuntimeParam("statement_timeout", strconv.FormatInt(d.Milliseconds(), 10))
+}
+
+// PostgresWithAfterConnect adds a hook that runs on every new connection before it is used,
+// e.g. to register custom types with conn.TypeMap(). Hooks run in the order they are given.
+func PostgresWithAfterConnect(fn func(ctx context.Context, conn *pgx.Conn) error) PostgresOption {
+	return func(o *postgresOptions) {
+		o.afterConnect = append(o.afterConnect, fn)
+	}
+}
+
+// apply applies the options to a parsed pool config. application_name defaults to Component.
+func (o *postgresOptions) apply(config *pgxpool.Config) error {
+	if len(o.errs) > 0 {
+		return errors.Join(o.errs...)
+	}
+
+	if _, ok := config.ConnConfig.RuntimeParams["application_name"]; !ok {
+		config.ConnConfig.RuntimeParams["application_name"] = Component
+	}
+	for name, value := range o.runtimeParams {
+		config.ConnConfig.RuntimeParams[name] = value
+	}
+
+	for _, fn := range o.pool {
+		fn(config)
+	}
+	if config.MinConns > config.MaxConns {
+		return fmt.Errorf("postgres min conns (%d) must not exceed max conns (%d)", config.MinConns, config.MaxConns)
+	}
+	if config.MinIdleConns > config.MaxConns {
+		return fmt.Errorf("postgres min idle conns (%d) must not exceed max conns (%d)", config.MinIdleConns, config.MaxConns)
+	}
+
+	if len(o.afterConnect) > 0 {
+		hooks := o.afterConnect
+		config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+			for _, hook := range hooks {
+				if err := hook(ctx, conn); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package odj
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Querier is the query interface shared by *pgxpool.Pool, *pgx.Conn and pgx.Tx.
+type Querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+var (
+	_ Querier = (*pgxpool.Pool)(nil)
+	_ Querier = (*pgx.Conn)(nil)
+	_ Querier = (pgx.Tx)(nil)
+)
+
+// NewQuerier returns a Querier that runs every statement in the transaction carried by its context,
+// e.g. one started with InTx or RunWithPgLock, and on pool otherwise. Repositories built on it can be
+// composed into a single transaction without changing their signatures.
+func NewQuerier(pool *pgxpool.Pool) Querier {
+	return ctxQuerier{pool: pool}
+}
+
+type ctxQuerier struct {
+	pool *pgxpool.Pool
+}
+
+func (q ctxQuerier) querier(ctx context.Context) Querier {
+	if tx, ok := TxFromContext(ctx); ok {
+		return tx
+	}
+	return q.pool
+}
+
+func (q ctxQuerier) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return q.querier(ctx).Exec(ctx, sql, args...)
+}
+
+func (q ctxQuerier) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return q.querier(ctx).Query(ctx, sql, args...)
+}
+
+func (q ctxQuerier) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return q.querier(ctx).QueryRow(ctx, sql, args...)
+}
+
+// TxFromContext returns the transaction carried by ctx, if any.
+func TxFromContext(ctx context.Context) (pgx.Tx, bool) {
+	tx, ok := ctx.Value(pgTxCtxKey{}).(pgx.Tx)
+	return tx, ok
+}
+
+// ContextWithTx returns a copy of ctx carrying tx, for transactions not started by InTx or RunWithPgLock.
+func ContextWithTx(ctx context.Context, tx pgx.Tx) context.Context {
+	return context.WithValue(ctx, pgTxCtxKey{}, tx)
+}
@@ -0,0 +1,173 @@
+package odj
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pedramktb/go-ctxslog"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PostgresWithSlowQueryLog logs queries that take longer than threshold as a warning, with their normalized SQL,
+// duration, affected rows, trace ID and the calling function. Queries that fail after exceeding it, e.g. because
+// they were cancelled by statement_timeout or their context, are logged with their error.
+func PostgresWithSlowQueryLog(threshold time.Duration) PostgresOption {
+	return func(o *postgresOptions) {
+		if threshold <= 0 {
+			o.err(fmt.Errorf("postgres slow query threshold must be positive, got %s", threshold))
+			return
+		}
+		o.slowQueryThreshold = threshold
+	}
+}
+
+// PostgresWithSlowQueryExplain logs the plan of a statement once it was logged as slow the given number of times.
+// The plan is fetched with EXPLAIN, without ANALYZE, using the arguments of the last slow run, and is neither traced
+// nor measured itself. Plans are never fetched in the prod stage. Requires PostgresWithSlowQueryLog.
+func PostgresWithSlowQueryExplain(after int) PostgresOption {
+	return func(o *postgresOptions) {
+		if after < 1 {
+			o.err(fmt.Errorf("postgres slow query explain count must be at least 1, got %d", after))
+			return
+		}
+		o.slowQueryExplainAfter = after
+	}
+}
+
+// maxPgSlowStatements bounds the number of distinct statements counted for PostgresWithSlowQueryExplain.
+const maxPgSlowStatements = 1000
+
+// pgSlowQueries logs slow queries and explains repeated offenders.
+type pgSlowQueries struct {
+	threshold    time.Duration
+	explainAfter int
+	maxLength    int
+	pool         atomic.Pointer[pgxpool.Pool]
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newPgSlowQueries(o *postgresOptions) *pgSlowQueries {
+	if o.slowQueryThreshold == 0 {
+		return nil
+	}
+	s := &pgSlowQueries{
+		threshold:    o.slowQueryThreshold,
+		explainAfter: o.slowQueryExplainAfter,
+		maxLength:    o.maxStatementLength,
+		counts:       make(map[string]int),
+	}
+	if s.maxLength == 0 {
+		s.maxLength = defaultPostgresMaxStatementLength
+	}
+	return s
+}
+
+// observe logs op if it exceeded the threshold, together with err if it failed.
+func (s *pgSlowQueries) observe(ctx context.Context, op *pgOperation, rows int64, err error) {
+	if s == nil {
+		return
+	}
+	duration := time.Since(op.start)
+	if duration < s.threshold {
+		return
+	}
+
+	sql := pgNormalizeSQL(op.sql)
+	attrs := []any{
+		slog.String("sql", pgTruncate(sql, s.maxLength)),
+		slog.Duration("duration", duration),
+		slog.Int64("rows", rows),
+		slog.String("trace_id", trace.SpanContextFromContext(ctx).TraceID().String()),
+		slog.String("caller", pgCaller()),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("err", err))
+	}
+	ctxslog.FromContext(ctx).WarnContext(ctx, "slow postgres query", attrs...)
+
+	if s.explainAfter > 0 && Stage != StageProd && s.count(sql) == s.explainAfter {
+		go s.explain(context.WithoutCancel(ctx), sql, op.sql, op.args)
+	}
+}
+
+// count increments and returns the number of slow runs of the normalized statement sql.
+func (s *pgSlowQueries) count(sql string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.counts[sql]
+	if !ok && len(s.counts) >= maxPgSlowStatements {
+		return 0
+	}
+	s.counts[sql] = n + 1
+	return n + 1
+}
+
+func (s *pgSlowQueries) explain(ctx context.Context, normalized, sql string, args []any) {
+	pool := s.pool.Load()
+	if pool == nil {
+		return
+	}
+	switch pgOperationName(sql) {
+	case "SELECT", "INSERT", "UPDATE", "DELETE", "MERGE", "WITH":
+	default:
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	logger := ctxslog.FromContext(ctx)
+	// EXPLAIN runs through the same tracer, which must not trace it or log it as slow in turn.
+	ctx = context.WithValue(ctx, pgUntracedCtxKey{}, true)
+
+	rows, err := pool.Query(ctx, "EXPLAIN "+sql, args...)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to explain slow postgres query", slog.String("sql", pgTruncate(normalized, s.maxLength)), slog.Any("err", err))
+		return
+	}
+	var plan []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			rows.Close()
+			logger.WarnContext(ctx, "failed to explain slow postgres query", slog.String("sql", pgTruncate(normalized, s.maxLength)), slog.Any("err", err))
+			return
+		}
+		plan = append(plan, line)
+	}
+	if err := rows.Err(); err != nil {
+		logger.WarnContext(ctx, "failed to explain slow postgres query", slog.String("sql", pgTruncate(normalized, s.maxLength)), slog.Any("err", err))
+		return
+	}
+
+	logger.InfoContext(ctx, "slow postgres query plan",
+		slog.String("sql", pgTruncate(normalized, s.maxLength)),
+		slog.String("plan", strings.Join(plan, "\n")),
+	)
+}
+
+// pgCaller returns the first function on the stack outside of pgx and the Postgres helpers of this package.
+func pgCaller() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		internal := strings.HasPrefix(frame.Function, "github.com/jackc/pgx/") ||
+			strings.HasPrefix(frame.Function, "github.com/pedramktb/go-odj.") && strings.HasPrefix(filepath.Base(frame.File), "postgres")
+		if !internal && frame.Function != "" {
+			return fmt.Sprintf("%s (%s:%d)", frame.Function, filepath.Base(frame.File), frame.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
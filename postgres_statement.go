@@ -0,0 +1,220 @@
+package odj
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+// PostgresStatementPolicy controls how much of a statement and its arguments is recorded on database spans.
+type PostgresStatementPolicy int
+
+const (
+	// PostgresStatementNormalized records the SQL with string, numeric and dollar-quoted literals replaced by "?".
+	// Placeholders such as $1 are kept. This is the default.
+	PostgresStatementNormalized PostgresStatementPolicy = iota
+	// PostgresStatementSQL records the SQL as sent, but no arguments.
+	PostgresStatementSQL
+	// PostgresStatementSQLWithArgsInDev records the SQL and its arguments in the dev and local stages,
+	// and behaves like PostgresStatementNormalized in all other stages.
+	PostgresStatementSQLWithArgsInDev
+)
+
+// defaultPostgresMaxStatementLength is the default maximum length in bytes of recorded statements and arguments.
+const defaultPostgresMaxStatementLength = 4096
+
+// PostgresWithStatementPolicy sets how statements and arguments are recorded on database spans.
+// Defaults to PostgresStatementNormalized.
+func PostgresWithStatementPolicy(policy PostgresStatementPolicy) PostgresOption {
+	return func(o *postgresOptions) {
+		if policy < PostgresStatementNormalized || policy > PostgresStatementSQLWithArgsInDev {
+			o.err(fmt.Errorf("unknown postgres statement policy %d", policy))
+			return
+		}
+		o.statementPolicy = policy
+	}
+}
+
+// PostgresWithMaxStatementLength truncates recorded statements and arguments to n bytes. Defaults to 4096.
+func PostgresWithMaxStatementLength(n int) PostgresOption {
+	return func(o *postgresOptions) {
+		if n < 1 {
+			o.err(fmt.Errorf("postgres max statement length must be at least 1, got %d", n))
+			return
+		}
+		o.maxStatementLength = n
+	}
+}
+
+// pgStatement renders sql and args as span attributes according to a statement policy.
+type pgStatement struct {
+	policy    PostgresStatementPolicy
+	maxLength int
+}
+
+func newPgStatement(o *postgresOptions) pgStatement {
+	s := pgStatement{policy: o.statementPolicy, maxLength: o.maxStatementLength}
+	if s.maxLength == 0 {
+		s.maxLength = defaultPostgresMaxStatementLength
+	}
+	return s
+}
+
+func (s pgStatement) attributes(sql string, args []any) []attribute.KeyValue {
+	policy := s.policy
+	if policy == PostgresStatementSQLWithArgsInDev && Stage != StageDev && Stage != StageLocal {
+		policy = PostgresStatementNormalized
+	}
+
+	if policy == PostgresStatementNormalized {
+		sql = pgNormalizeSQL(sql)
+	}
+	attrs := []attribute.KeyValue{semconv.DBQueryText(pgTruncate(sql, s.maxLength))}
+	if policy == PostgresStatementSQLWithArgsInDev {
+		for i, arg := range args {
+			attrs = append(attrs, semconv.DBQueryParameter(strconv.Itoa(i+1), pgTruncate(pgFormatArg(arg), s.maxLength)))
+		}
+	}
+	return attrs
+}
+
+func pgFormatArg(arg any) string {
+	switch v := arg.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return v
+	case []byte:
+		return fmt.Sprintf("\\x%x", v)
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// pgTruncate shortens s to at most n bytes without splitting a UTF-8 sequence.
+func pgTruncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// pgNormalizeSQL replaces string, escape string, dollar-quoted and numeric literals in sql by "?".
+// Identifiers, quoted identifiers, comments and placeholders are kept as they are.
+func pgNormalizeSQL(sql string) string {
+	var b strings.Builder
+	b.Grow(len(sql))
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql) - i
+			}
+			b.WriteString(sql[i : i+end])
+			i += end
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				end = len(sql) - i
+			} else {
+				end += 4
+			}
+			b.WriteString(sql[i : i+end])
+			i += end
+		case c == '"':
+			end := pgQuotedEnd(sql, i, '"')
+			b.WriteString(sql[i:end])
+			i = end
+		case c == '\'':
+			b.WriteByte('?')
+			i = pgQuotedEnd(sql, i, '\'')
+		case (c == 'E' || c == 'e' || c == 'B' || c == 'b' || c == 'X' || c == 'x') &&
+			i+1 < len(sql) && sql[i+1] == '\'' && (i == 0 || !pgIdentByte(sql[i-1])):
+			b.WriteByte('?')
+			i = pgQuotedEnd(sql, i+1, '\'')
+		case c == '$' && (i == 0 || !pgIdentByte(sql[i-1])):
+			tag, ok := pgDollarTag(sql[i:])
+			if !ok {
+				// A placeholder such as $1, or a lone dollar sign.
+				end := i + 1
+				for end < len(sql) && sql[end] >= '0' && sql[end] <= '9' {
+					end++
+				}
+				b.WriteString(sql[i:end])
+				i = end
+				continue
+			}
+			b.WriteByte('?')
+			if end := strings.Index(sql[i+len(tag):], tag); end >= 0 {
+				i += len(tag) + end + len(tag)
+			} else {
+				i = len(sql)
+			}
+		case c >= '0' && c <= '9' && (i == 0 || !pgIdentByte(sql[i-1])) ||
+			c == '.' && i+1 < len(sql) && sql[i+1] >= '0' && sql[i+1] <= '9' && (i == 0 || !pgIdentByte(sql[i-1])):
+			b.WriteByte('?')
+			i++
+			for i < len(sql) && (pgIdentByte(sql[i]) || sql[i] == '.' ||
+				(sql[i] == '+' || sql[i] == '-') && (sql[i-1] == 'e' || sql[i-1] == 'E')) {
+				i++
+			}
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// pgQuotedEnd returns the index after the quoted section starting at sql[start], where doubled quotes are escapes.
+// Backslash escapes are skipped as well, which only matters for escape strings and cannot end a section early otherwise.
+func pgQuotedEnd(sql string, start int, quote byte) int {
+	for i := start + 1; i < len(sql); i++ {
+		switch sql[i] {
+		case '\\':
+			if quote == '\'' && start > 0 && (sql[start-1] == 'E' || sql[start-1] == 'e') {
+				i++
+			}
+		case quote:
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(sql)
+}
+
+// pgDollarTag returns the opening tag of a dollar-quoted string at the start of s, e.g. "$$" or "$body$".
+func pgDollarTag(s string) (string, bool) {
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '$':
+			return s[:i+1], true
+		case c >= '0' && c <= '9':
+			if i == 1 {
+				return "", false
+			}
+		case !pgIdentByte(c):
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// pgIdentByte reports whether c may continue an identifier, which in Postgres may contain dollar signs.
+func pgIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
@@ -0,0 +1,60 @@
+package odj
+
+import "testing"
+
+func TestPgNormalizeSQL(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want string
+	}{
+		{name: "string literal", sql: "SELECT * FROM users WHERE email = 'jane@example.com'", want: "SELECT * FROM users WHERE email = ?"},
+		{name: "doubled quote", sql: "SELECT 'it''s' , 'x'", want: "SELECT ? , ?"},
+		{name: "standard string keeps backslash literal", sql: `SELECT 'a\' , 'secret'`, want: "SELECT ? , ?"},
+		{name: "escape string", sql: `SELECT E'it\'s secret', e'\\'`, want: "SELECT ?, ?"},
+		{name: "escape string with doubled quote", sql: `SELECT E'a''b\n'`, want: "SELECT ?"},
+		{name: "bit and hex strings", sql: "SELECT B'1010', X'ff'", want: "SELECT ?, ?"},
+		{name: "identifier ending in e before string", sql: "SELECT name'x'", want: "SELECT name?"},
+		{name: "unicode string", sql: "SELECT U&'d\\0061t'", want: "SELECT U&?"},
+		{name: "dollar quote", sql: "SELECT $$jane@example.com$$", want: "SELECT ?"},
+		{name: "tagged dollar quote", sql: "SELECT $body$ it's $$ nested $body$ FROM t", want: "SELECT ? FROM t"},
+		{name: "unterminated dollar quote", sql: "SELECT $x$ secret", want: "SELECT ?"},
+		{name: "placeholders", sql: "SELECT * FROM t WHERE a = $1 AND b = $12", want: "SELECT * FROM t WHERE a = $1 AND b = $12"},
+		{name: "dollar in identifier", sql: "SELECT a$1, b$x$ FROM t", want: "SELECT a$1, b$x$ FROM t"},
+		{name: "numbers", sql: "SELECT 42, 3.14, .5, 1e10, 2.5E-3 FROM t LIMIT 10", want: "SELECT ?, ?, ?, ?, ? FROM t LIMIT ?"},
+		{name: "digits in identifiers", sql: "SELECT col1 FROM t2", want: "SELECT col1 FROM t2"},
+		{name: "quoted identifier", sql: `SELECT "it's" FROM "My ""Table"""`, want: `SELECT "it's" FROM "My ""Table"""`},
+		{name: "line comment", sql: "SELECT 1 -- don't 'touch'\nFROM t", want: "SELECT ? -- don't 'touch'\nFROM t"},
+		{name: "unterminated line comment", sql: "SELECT 1 -- 'x'", want: "SELECT ? -- 'x'"},
+		{name: "block comment", sql: "SELECT /* it's 'x' */ 'y'", want: "SELECT /* it's 'x' */ ?"},
+		{name: "unterminated block comment", sql: "SELECT 'y' /* 'x'", want: "SELECT ? /* 'x'"},
+		{name: "unterminated string", sql: "SELECT 'secret", want: "SELECT ?"},
+		{name: "casts", sql: "SELECT '2024-01-01'::date, 1::int", want: "SELECT ?::date, ?::int"},
+		{name: "empty", sql: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pgNormalizeSQL(tt.sql); got != tt.want {
+				t.Errorf("pgNormalizeSQL(%q) = %q, want %q", tt.sql, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPgTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{s: "abc", n: 5, want: "abc"},
+		{s: "abcdef", n: 3, want: "abc"},
+		{s: "aé", n: 2, want: "a"},
+		{s: "日本", n: 4, want: "日"},
+	}
+	for _, tt := range tests {
+		if got := pgTruncate(tt.s, tt.n); got != tt.want {
+			t.Errorf("pgTruncate(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package odj
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pedramktb/go-typx"
+	"github.com/testcontainers/testcontainers-go"
+)
+
+// postgresTemplates remembers the template databases already migrated by this process, per container and template.
+var postgresTemplates sync.Map
+
+// postgresTemplate guards the creation of one template database. A failed creation is not remembered,
+// so that the next test tries again instead of failing on a transient error of the first one.
+type postgresTemplate struct {
+	mu      sync.Mutex
+	created bool
+}
+
+// PostgresTestContainerSetupMigratedDB is like PostgresTestContainerSetupDB, but the database is a copy of a template
+// database that has the given migrations applied with Migrate. The template is migrated once per container and set
+// of migrations, and every test database is cloned from it with CREATE DATABASE ... TEMPLATE, which is much faster
+// than migrating each one. It is safe to use from parallel tests. Errors fail the test.
+func PostgresTestContainerSetupMigratedDB(ctx context.Context, t *testing.T, container testcontainers.Container, migrations fs.FS, opts ...typx.KV[string, string]) *pgxpool.Pool {
+	t.Helper()
+
+	template, err := postgresTestContainerTemplate(ctx, container, migrations, opts...)
+	if err != nil {
+		t.Fatalf("failed to set up template database: %v", err)
+	}
+
+	name := postgresTestDBName(t)
+	if err := postgresTestContainerCloneDB(ctx, container, template, name, opts...); err != nil {
+		t.Fatalf("failed to set up test database: %v", err)
+	}
+	pool := postgresTestContainerConnection(ctx, container, name, opts...)
+	t.Cleanup(func() {
+		PostgresTestContainerDropDB(ctx, container, name, pool, opts...)
+	})
+	return pool
+}
+
+// postgresTestContainerTemplate returns the name of the template database for migrations, creating and migrating it
+// if needed. The name derives from the migrations' checksums, so edited or added migrations get a fresh template.
+func postgresTestContainerTemplate(ctx context.Context, container testcontainers.Container, migrations fs.FS, opts ...typx.KV[string, string]) (string, error) {
+	loaded, err := loadMigrations(migrations)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, m := range loaded {
+		_, _ = fmt.Fprintf(h, "%d:%s\n", m.version, m.checksum)
+	}
+	name := "odj_template_" + hex.EncodeToString(h.Sum(nil))[:16]
+
+	v, _ := postgresTemplates.LoadOrStore(container.GetContainerID()+"/"+name, &postgresTemplate{})
+	tmpl := v.(*postgresTemplate)
+	tmpl.mu.Lock()
+	defer tmpl.mu.Unlock()
+	if !tmpl.created {
+		if err := postgresTestContainerCreateTemplate(ctx, container, name, migrations, opts...); err != nil {
+			return "", err
+		}
+		tmpl.created = true
+	}
+	return name, nil
+}
+
+func postgresTestContainerCreateTemplate(ctx context.Context, container testcontainers.Container, name string, migrations fs.FS, opts ...typx.KV[string, string]) error {
+	admin := postgresTestContainerConnection(ctx, container, "postgres", opts...)
+	defer admin.Close()
+
+	// Other processes, e.g. test binaries of other packages sharing the container, may create the same template.
+	conn, err := admin.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection for template database %s: %w", name, err)
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", pgLockID("odj-template:"+name)); err != nil {
+		return fmt.Errorf("failed to lock template database %s: %w", name, err)
+	}
+	defer func() {
+		_, _ = conn.Exec(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", pgLockID("odj-template:"+name))
+	}()
+
+	var exists bool
+	if err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1 AND datistemplate)", name).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up template database %s: %w", name, err)
+	}
+	if exists {
+		return nil
+	}
+
+	// A template left behind half-migrated by a crashed run is not marked as template yet and is replaced.
+	if _, err := conn.Exec(ctx, fmt.Sprintf("DROP DATABASE IF EXISTS %s WITH (force)", pgx.Identifier{name}.Sanitize())); err != nil {
+		return fmt.Errorf("failed to drop incomplete template database %s: %w", name, err)
+	}
+	if _, err := conn.Exec(ctx, fmt.Sprintf("CREATE DATABASE %s", pgx.Identifier{name}.Sanitize())); err != nil {
+		return fmt.Errorf("failed to create template database %s: %w", name, err)
+	}
+
+	pool := postgresTestContainerConnection(ctx, container, name, opts...)
+	err = Migrate(ctx, pool, migrations)
+	// No connection to the template may remain open, or it cannot be cloned.
+	pool.Close()
+	if err != nil {
+		return fmt.Errorf("failed to migrate template database %s: %w", name, err)
+	}
+
+	if _, err := conn.Exec(ctx, fmt.Sprintf("ALTER DATABASE %s WITH IS_TEMPLATE true", pgx.Identifier{name}.Sanitize())); err != nil {
+		return fmt.Errorf("failed to mark template database %s: %w", name, err)
+	}
+	return nil
+}
+
+// postgresTestContainerCloneDB creates the database name as a copy of template. Cloning fails while another session
+// is connected to the template, so it is retried for a while.
+func postgresTestContainerCloneDB(ctx context.Context, container testcontainers.Container, template, name string, opts ...typx.KV[string, string]) error {
+	admin := postgresTestContainerConnection(ctx, container, "postgres", opts...)
+	defer admin.Close()
+	if err := postgresTestDBRegister(ctx, admin, name); err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		_, err := admin.Exec(ctx, fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s", pgx.Identifier{name}.Sanitize(), pgx.Identifier{template}.Sanitize()))
+		var pgErr *pgconn.PgError
+		if attempt < 50 && errors.As(err, &pgErr) && pgErr.Code == "55006" { // object_in_use
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(100 * time.Millisecond):
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to clone template database %s into %s: %w", template, name, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,157 @@
+package odj
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/testcontainers/testcontainers-go"
+	postgresC "github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// PostgresContainerOption configures the container started by StartPostgresTestContainer and RunPostgresTestContainer.
+type PostgresContainerOption func(*postgresContainerOptions)
+
+type postgresContainerOptions struct {
+	image       string
+	initScripts []string
+	extensions  []string
+	settings    []string
+	reuseName   string
+}
+
+// PostgresContainerWithImage sets the image, e.g. a PostGIS or pgvector variant. Defaults to "postgres:18.1".
+func PostgresContainerWithImage(image string) PostgresContainerOption {
+	return func(o *postgresContainerOptions) {
+		o.image = image
+	}
+}
+
+// PostgresContainerWithInitScripts runs the given .sql or .sh files on the host in order when the database is initialized.
+func PostgresContainerWithInitScripts(paths ...string) PostgresContainerOption {
+	return func(o *postgresContainerOptions) {
+		o.initScripts = append(o.initScripts, paths...)
+	}
+}
+
+// PostgresContainerWithExtensions creates the given extensions, which the image must provide, in the template1 and
+// postgres databases, so that every database created afterwards, including test databases, has them.
+// They are created before any init scripts run.
+func PostgresContainerWithExtensions(names ...string) PostgresContainerOption {
+	return func(o *postgresContainerOptions) {
+		o.extensions = append(o.extensions, names...)
+	}
+}
+
+// PostgresContainerWithSetting sets a postgresql.conf setting on the server command line, e.g. "max_connections"
+// to "500". Durability is traded for speed by default with fsync and synchronous_commit set to "off",
+// which this option can override.
+func PostgresContainerWithSetting(name, value string) PostgresContainerOption {
+	return func(o *postgresContainerOptions) {
+		o.settings = append(o.settings, "-c", name+"="+value)
+	}
+}
+
+// PostgresContainerWithReuse reuses the running container with the given name, or starts one with that name,
+// so that the test binaries of several packages share one container. Reused containers are never terminated
+// by this package.
+func PostgresContainerWithReuse(name string) PostgresContainerOption {
+	return func(o *postgresContainerOptions) {
+		o.reuseName = name
+	}
+}
+
+// StartPostgresTestContainer is like PostgresTestContainer, but takes typed options, returns errors instead of
+// panicking and terminates the container when tb finishes, unless it is reused.
+func StartPostgresTestContainer(ctx context.Context, tb testing.TB, opts ...PostgresContainerOption) (testcontainers.Container, error) {
+	tb.Helper()
+	container, terminate, err := RunPostgresTestContainer(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	tb.Cleanup(func() {
+		if err := terminate(); err != nil {
+			tb.Errorf("failed to terminate postgres test container: %v", err)
+		}
+	})
+	return container, nil
+}
+
+// RunPostgresTestContainer is like StartPostgresTestContainer for code without a testing.TB, such as TestMain.
+// The returned function terminates the container, unless it is reused, and must be called when it is no longer needed.
+func RunPostgresTestContainer(ctx context.Context, opts ...PostgresContainerOption) (container testcontainers.Container, terminate func() error, err error) {
+	o := postgresContainerOptions{image: "postgres:18.1"}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	container, err = runPostgresTestContainer(ctx, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	if o.reuseName != "" {
+		return container, func() error { return nil }, nil
+	}
+	return container, func() error { return testcontainers.TerminateContainer(container) }, nil
+}
+
+func runPostgresTestContainer(ctx context.Context, o postgresContainerOptions) (testcontainers.Container, error) {
+	_ = os.Setenv("TZ", "UTC")
+
+	var files []testcontainers.ContainerFile
+	if len(o.extensions) > 0 {
+		var script strings.Builder
+		for _, db := range []string{"template1", "postgres"} {
+			fmt.Fprintf(&script, "\\connect %s\n", db)
+			for _, ext := range o.extensions {
+				fmt.Fprintf(&script, "CREATE EXTENSION IF NOT EXISTS %s;\n", pgx.Identifier{ext}.Sanitize())
+			}
+		}
+		files = append(files, testcontainers.ContainerFile{
+			Reader:            strings.NewReader(script.String()),
+			ContainerFilePath: "/docker-entrypoint-initdb.d/000-odj-extensions.sql",
+			FileMode:          0o644,
+		})
+	}
+	for i, path := range o.initScripts {
+		mode := int64(0o644)
+		if filepath.Ext(path) == ".sh" {
+			mode = 0o755
+		}
+		files = append(files, testcontainers.ContainerFile{
+			HostFilePath:      path,
+			ContainerFilePath: fmt.Sprintf("/docker-entrypoint-initdb.d/%03d-%s", i+1, filepath.Base(path)),
+			FileMode:          mode,
+		})
+	}
+
+	customizers := []testcontainers.ContainerCustomizer{
+		postgresC.WithUsername("test"),
+		postgresC.WithPassword("test"),
+		testcontainers.WithWaitStrategy(
+			wait.ForLog("database system is ready to accept connections").
+				WithOccurrence(2).
+				WithStartupTimeout(time.Minute)),
+	}
+	if len(files) > 0 {
+		customizers = append(customizers, testcontainers.WithFiles(files...))
+	}
+	customizers = append(customizers, testcontainers.WithCmd(append([]string{"postgres",
+		"-c", "fsync=off",
+		"-c", "synchronous_commit=off",
+	}, o.settings...)...))
+	if o.reuseName != "" {
+		customizers = append(customizers, testcontainers.WithReuseByName(o.reuseName))
+	}
+
+	container, err := postgresC.Run(ctx, o.image, customizers...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start postgres test container: %w", err)
+	}
+	return container, nil
+}
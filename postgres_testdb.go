@@ -0,0 +1,137 @@
+package odj
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pedramktb/go-typx"
+	"github.com/testcontainers/testcontainers-go"
+)
+
+// postgresTestRunID tells apart the databases of concurrent test processes, e.g. of packages with equally named tests.
+var postgresTestRunID = fmt.Sprintf("%06x", rand.Uint32()&0xffffff)
+
+// postgresTestDBName derives a database name from the name of the test. The name consists of the sanitized and, if
+// needed, truncated test name, a hash of the full test name and the run ID, which keeps it within the 63 byte limit
+// of Postgres identifiers and unique for long names, names differing only in special characters, and concurrent runs.
+func postgresTestDBName(t testing.TB) string {
+	sum := sha256.Sum256([]byte(t.Name()))
+	suffix := "_" + hex.EncodeToString(sum[:4]) + "_" + postgresTestRunID
+
+	var b strings.Builder
+	for _, r := range strings.ToLower(t.Name()) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		} else if s := b.String(); s != "" && !strings.HasSuffix(s, "_") {
+			b.WriteByte('_')
+		}
+	}
+	prefix := b.String()
+	prefix = strings.TrimSuffix(prefix[:min(len(prefix), 63-len(suffix))], "_")
+	if prefix == "" {
+		prefix = "test"
+	}
+	return prefix + suffix
+}
+
+// postgresTestDBRegistry is the table in the "postgres" database that records the databases created for tests,
+// so that the ones leaked by crashed test runs can be reaped with PostgresTestContainerReapDBs.
+const postgresTestDBRegistry = "odj_test_databases"
+
+// postgresTestDBRegister records name in the registry. It is called before the database is created, so that a crash
+// right after creating it does not leak it. It runs in a transaction of its own on admin, even if ctx carries one.
+func postgresTestDBRegister(ctx context.Context, admin *pgxpool.Pool, name string) error {
+	tx, err := admin.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin tx for test database registry: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// Concurrent CREATE TABLE IF NOT EXISTS statements can still conflict.
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", pgLockID(postgresTestDBRegistry)); err != nil {
+		return fmt.Errorf("failed to lock test database registry: %w", err)
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	name text PRIMARY KEY,
+	run_id text NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now()
+)`, postgresTestDBRegistry)); err != nil {
+		return fmt.Errorf("failed to create test database registry: %w", err)
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s (name, run_id) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING", postgresTestDBRegistry), name, postgresTestRunID); err != nil {
+		return fmt.Errorf("failed to register test database %s: %w", name, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit test database registry: %w", err)
+	}
+	return nil
+}
+
+func postgresTestDBUnregister(ctx context.Context, admin *pgxpool.Pool, name string) {
+	_, _ = admin.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE name = $1", postgresTestDBRegistry), name)
+}
+
+// PostgresTestContainerReapDBs drops the test databases that were created more than olderThan ago and never dropped,
+// e.g. because their test run crashed. This is mostly useful with containers that outlive a test run.
+func PostgresTestContainerReapDBs(ctx context.Context, container testcontainers.Container, olderThan time.Duration, opts ...typx.KV[string, string]) error {
+	admin := postgresTestContainerConnection(ctx, container, "postgres", opts...)
+	defer admin.Close()
+
+	var exists bool
+	if err := admin.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", postgresTestDBRegistry).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up test database registry: %w", err)
+	}
+	if !exists {
+		return nil
+	}
+
+	rows, err := admin.Query(ctx, fmt.Sprintf("SELECT name FROM %s WHERE created_at < now() - $1::interval", postgresTestDBRegistry), olderThan)
+	if err != nil {
+		return fmt.Errorf("failed to list leaked test databases: %w", err)
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to list leaked test databases: %w", err)
+	}
+
+	for _, name := range names {
+		if _, err := admin.Exec(ctx, fmt.Sprintf("DROP DATABASE IF EXISTS %s WITH (force)", pgx.Identifier{name}.Sanitize())); err != nil {
+			return fmt.Errorf("failed to drop leaked test database %s: %w", name, err)
+		}
+		postgresTestDBUnregister(ctx, admin, name)
+	}
+	return nil
+}
+
+// PostgresTestContainerLeakedDBs lists the test databases this process created in container and has not dropped yet.
+// Called after all tests ran, e.g. from TestMain, it reports the databases leaked by tests.
+func PostgresTestContainerLeakedDBs(ctx context.Context, container testcontainers.Container, opts ...typx.KV[string, string]) ([]string, error) {
+	admin := postgresTestContainerConnection(ctx, container, "postgres", opts...)
+	defer admin.Close()
+
+	var exists bool
+	if err := admin.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", postgresTestDBRegistry).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to look up test database registry: %w", err)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	rows, err := admin.Query(ctx, fmt.Sprintf("SELECT name FROM %s WHERE run_id = $1 ORDER BY name", postgresTestDBRegistry), postgresTestRunID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list leaked test databases: %w", err)
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to list leaked test databases: %w", err)
+	}
+	return names, nil
+}
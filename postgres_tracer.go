@@ -0,0 +1,326 @@
+package odj
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pedramktb/go-tagerr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PostgresWithTracerProvider sets the tracer provider used for database spans that have no parent span,
+// see PostgresWithRootSpans. Spans with a parent always use the parent's provider. Defaults to the global tracer provider.
+func PostgresWithTracerProvider(tp trace.TracerProvider) PostgresOption {
+	return func(o *postgresOptions) {
+		o.tracerProvider = tp
+	}
+}
+
+// PostgresWithRootSpans traces database operations outside of any trace as root spans of their own.
+// By default only operations within an existing trace are traced, as background pool activity such as
+// connecting or health checks would otherwise flood the tracing backend with one-span traces.
+// Metrics are recorded for all operations either way.
+func PostgresWithRootSpans() PostgresOption {
+	return func(o *postgresOptions) {
+		o.rootSpans = true
+	}
+}
+
+// pgTracer creates OpenTelemetry client spans following the database semantic conventions for every query, batch,
+// copy, prepare, connect and pool acquire of a pgx connection pool within a trace, and records the duration of every
+// operation.
+type pgTracer struct {
+	tracerProvider trace.TracerProvider
+	rootSpans      bool
+	statement      pgStatement
+	metrics        *pgMetrics
+	slow           *pgSlowQueries
+}
+
+var (
+	_ pgx.QueryTracer       = (*pgTracer)(nil)
+	_ pgx.BatchTracer       = (*pgTracer)(nil)
+	_ pgx.CopyFromTracer    = (*pgTracer)(nil)
+	_ pgx.PrepareTracer     = (*pgTracer)(nil)
+	_ pgx.ConnectTracer     = (*pgTracer)(nil)
+	_ pgxpool.AcquireTracer = (*pgTracer)(nil)
+)
+
+func newPgTracer(o *postgresOptions, metrics *pgMetrics) *pgTracer {
+	return &pgTracer{
+		tracerProvider: o.tracerProvider,
+		rootSpans:      o.rootSpans,
+		statement:      newPgStatement(o),
+		metrics:        metrics,
+		slow:           newPgSlowQueries(o),
+	}
+}
+
+// pgOperation is carried in the context from the start to the end of a traced operation.
+type pgOperation struct {
+	start      time.Time
+	name       string
+	collection string
+	sql        string
+	args       []any
+}
+
+type pgOperationCtxKey struct{}
+
+// pgUntracedCtxKey marks the context of queries the package runs on behalf of the tracer itself, such as the EXPLAIN
+// of a slow query, which must neither be traced, measured nor logged as slow again.
+type pgUntracedCtxKey struct{}
+
+func pgUntraced(ctx context.Context) bool {
+	return ctx.Value(pgUntracedCtxKey{}) != nil
+}
+
+func (t *pgTracer) begin(ctx context.Context, op *pgOperation) context.Context {
+	op.start = time.Now()
+	return context.WithValue(ctx, pgOperationCtxKey{}, op)
+}
+
+// finish records the metrics of the operation started with begin and ends the span of ctx.
+func (t *pgTracer) finish(ctx context.Context, cfg *pgconn.Config, err error) {
+	if op, ok := ctx.Value(pgOperationCtxKey{}).(*pgOperation); ok {
+		t.metrics.record(ctx, op.start, cfg, op.name, op.collection, err)
+	}
+	pgEndSpan(trace.SpanFromContext(ctx), err)
+}
+
+// start starts a client span for an operation. Without a parent span it returns ctx and its non-recording span
+// unless root spans are enabled.
+func (t *pgTracer) start(ctx context.Context, name string, cfg *pgconn.Config, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tp := t.tracerProvider
+	if parent := trace.SpanFromContext(ctx); parent.SpanContext().IsValid() {
+		tp = parent.TracerProvider()
+	} else if !t.rootSpans {
+		return ctx, parent
+	} else if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer("github.com/pedramktb/go-odj/postgres").Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(pgConnAttributes(cfg)...),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+func (t *pgTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	if pgUntraced(ctx) {
+		return ctx
+	}
+	op := pgOperationName(data.SQL)
+	collection := pgCollectionName(data.SQL)
+	attrs := append(t.statement.attributes(data.SQL, data.Args), semconv.DBOperationName(op))
+	if collection != "" {
+		attrs = append(attrs, semconv.DBCollectionName(collection))
+	}
+	ctx, _ = t.start(ctx, pgSpanName(op, conn.Config().Database), &conn.Config().Config, attrs...)
+	return t.begin(ctx, &pgOperation{name: op, collection: collection, sql: data.SQL, args: data.Args})
+}
+
+func (t *pgTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	if pgUntraced(ctx) {
+		return
+	}
+	if op, ok := ctx.Value(pgOperationCtxKey{}).(*pgOperation); ok {
+		t.slow.observe(ctx, op, data.CommandTag.RowsAffected(), data.Err)
+	}
+	pgSetCommandTag(trace.SpanFromContext(ctx), data.CommandTag)
+	t.finish(ctx, &conn.Config().Config, data.Err)
+}
+
+func (t *pgTracer) TraceBatchStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	if pgUntraced(ctx) {
+		return ctx
+	}
+	size := 0
+	if data.Batch != nil {
+		size = data.Batch.Len()
+	}
+	ctx, _ = t.start(ctx, pgSpanName("BATCH", conn.Config().Database), &conn.Config().Config,
+		semconv.DBOperationName("BATCH"),
+		semconv.DBOperationBatchSize(size),
+	)
+	return t.begin(ctx, &pgOperation{name: "BATCH"})
+}
+
+func (t *pgTracer) TraceBatchQuery(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchQueryData) {
+	if pgUntraced(ctx) {
+		return
+	}
+	attrs := append(t.statement.attributes(data.SQL, data.Args),
+		semconv.DBOperationName(pgOperationName(data.SQL)),
+		attribute.Int64("db.response.rows_affected", data.CommandTag.RowsAffected()),
+	)
+	if data.Err != nil {
+		attrs = append(attrs, attribute.String("exception.message", data.Err.Error()))
+	}
+	trace.SpanFromContext(ctx).AddEvent("query", trace.WithAttributes(attrs...))
+}
+
+func (t *pgTracer) TraceBatchEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchEndData) {
+	if pgUntraced(ctx) {
+		return
+	}
+	t.finish(ctx, &conn.Config().Config, data.Err)
+}
+
+func (t *pgTracer) TraceCopyFromStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	if pgUntraced(ctx) {
+		return ctx
+	}
+	table := data.TableName.Sanitize()
+	ctx, _ = t.start(ctx, "COPY "+table, &conn.Config().Config,
+		semconv.DBOperationName("COPY"),
+		semconv.DBCollectionName(table),
+	)
+	return t.begin(ctx, &pgOperation{name: "COPY", collection: table})
+}
+
+func (t *pgTracer) TraceCopyFromEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	if pgUntraced(ctx) {
+		return
+	}
+	pgSetCommandTag(trace.SpanFromContext(ctx), data.CommandTag)
+	t.finish(ctx, &conn.Config().Config, data.Err)
+}
+
+func (t *pgTracer) TracePrepareStart(ctx context.Context, conn *pgx.Conn, data pgx.TracePrepareStartData) context.Context {
+	if pgUntraced(ctx) {
+		return ctx
+	}
+	ctx, _ = t.start(ctx, pgSpanName("PREPARE", conn.Config().Database), &conn.Config().Config,
+		append(t.statement.attributes(data.SQL, nil),
+			semconv.DBOperationName("PREPARE"),
+			attribute.String("db.postgresql.statement_name", data.Name),
+		)...,
+	)
+	return t.begin(ctx, &pgOperation{name: "PREPARE", sql: data.SQL})
+}
+
+func (t *pgTracer) TracePrepareEnd(ctx context.Context, conn *pgx.Conn, data pgx.TracePrepareEndData) {
+	if pgUntraced(ctx) {
+		return
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("db.postgresql.already_prepared", data.AlreadyPrepared))
+	t.finish(ctx, &conn.Config().Config, data.Err)
+}
+
+func (t *pgTracer) TraceConnectStart(ctx context.Context, data pgx.TraceConnectStartData) context.Context {
+	if pgUntraced(ctx) {
+		return ctx
+	}
+	ctx, _ = t.start(ctx, pgSpanName("CONNECT", data.ConnConfig.Database), &data.ConnConfig.Config,
+		semconv.DBOperationName("CONNECT"),
+	)
+	return ctx
+}
+
+func (t *pgTracer) TraceConnectEnd(ctx context.Context, data pgx.TraceConnectEndData) {
+	if pgUntraced(ctx) {
+		return
+	}
+	pgEndSpan(trace.SpanFromContext(ctx), data.Err)
+}
+
+// TraceAcquireStart records the time spent waiting for a pool connection. Acquiring is only traced within
+// an existing trace, even with root spans enabled, as a root span for every acquire would be noise.
+func (t *pgTracer) TraceAcquireStart(ctx context.Context, pool *pgxpool.Pool, data pgxpool.TraceAcquireStartData) context.Context {
+	if pgUntraced(ctx) || !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+		return ctx
+	}
+	ctx, _ = t.start(ctx, "pgxpool.acquire", &pool.Config().ConnConfig.Config)
+	return ctx
+}
+
+func (t *pgTracer) TraceAcquireEnd(ctx context.Context, pool *pgxpool.Pool, data pgxpool.TraceAcquireEndData) {
+	span := trace.SpanFromContext(ctx)
+	if pgUntraced(ctx) || !span.IsRecording() {
+		return
+	}
+	pgEndSpan(span, data.Err)
+}
+
+func pgConnAttributes(cfg *pgconn.Config) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.DBSystemNamePostgreSQL,
+		semconv.DBNamespace(cfg.Database),
+		semconv.ServerAddress(cfg.Host),
+		semconv.ServerPort(int(cfg.Port)),
+	}
+}
+
+func pgSetCommandTag(span trace.Span, tag pgconn.CommandTag) {
+	if tag.Select() {
+		span.SetAttributes(semconv.DBResponseReturnedRows(int(tag.RowsAffected())))
+	} else {
+		span.SetAttributes(attribute.Int64("db.response.rows_affected", tag.RowsAffected()))
+	}
+}
+
+func pgEndSpan(span trace.Span, err error) {
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			span.SetAttributes(semconv.DBResponseStatusCode(pgErr.Code))
+		}
+		var tagErr *tagerr.Err
+		if errors.As(err, &tagErr) && tagErr.Stack() != "" {
+			span.RecordError(err, trace.WithAttributes(semconv.ExceptionStacktrace(tagErr.Stack())))
+		} else {
+			span.RecordError(err)
+		}
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// pgSpanName builds a span name of the form "{db.operation.name} {db.namespace}".
+func pgSpanName(op, namespace string) string {
+	if op == "" {
+		return "postgresql"
+	}
+	if namespace == "" {
+		return op
+	}
+	return op + " " + namespace
+}
+
+// pgOperationName returns the upper-cased first keyword of sql, skipping leading whitespace and comments.
+func pgOperationName(sql string) string {
+	for {
+		sql = strings.TrimLeft(sql, " \t\r\n(")
+		switch {
+		case strings.HasPrefix(sql, "--"):
+			if i := strings.IndexByte(sql, '\n'); i >= 0 {
+				sql = sql[i+1:]
+				continue
+			}
+			return ""
+		case strings.HasPrefix(sql, "/*"):
+			if i := strings.Index(sql, "*/"); i >= 0 {
+				sql = sql[i+2:]
+				continue
+			}
+			return ""
+		}
+		end := strings.IndexFunc(sql, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+		})
+		if end < 0 {
+			end = len(sql)
+		}
+		return strings.ToUpper(sql[:end])
+	}
+}
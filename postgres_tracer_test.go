@@ -0,0 +1,66 @@
+package odj
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestPgTracerRootSpans(t *testing.T) {
+	tests := []struct {
+		name      string
+		rootSpans bool
+		parent    bool
+		wantSpan  bool
+	}{
+		{name: "without parent"},
+		{name: "with parent", parent: true, wantSpan: true},
+		{name: "root spans without parent", rootSpans: true, wantSpan: true},
+		{name: "root spans with parent", rootSpans: true, parent: true, wantSpan: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+			tracer := &pgTracer{tracerProvider: tp, rootSpans: tt.rootSpans}
+
+			ctx := context.Background()
+			if tt.parent {
+				ctx, _ = tp.Tracer("test").Start(ctx, "parent")
+			}
+			_, span := tracer.start(ctx, "SELECT app", &pgconn.Config{})
+			pgEndSpan(span, nil)
+
+			ended := recorder.Ended()
+			if got := len(ended) == 1; got != tt.wantSpan {
+				t.Fatalf("got %d ended spans, want span %v", len(ended), tt.wantSpan)
+			}
+			if tt.wantSpan && ended[0].Parent().IsValid() != tt.parent {
+				t.Errorf("got span with parent %v, want parent %v", ended[0].Parent().IsValid(), tt.parent)
+			}
+		})
+	}
+}
+
+func TestPgTracerSkipsUntracedQueries(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := &pgTracer{tracerProvider: tp, rootSpans: true, slow: &pgSlowQueries{}}
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	ctx = context.WithValue(ctx, pgUntracedCtxKey{}, true)
+	// The connection is not touched for untraced queries.
+	ctx = tracer.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{SQL: "EXPLAIN SELECT 1"})
+	tracer.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{})
+
+	if ended := recorder.Ended(); len(ended) != 0 {
+		t.Errorf("got %d ended spans for an untraced query, want 0", len(ended))
+	}
+	if !parent.IsRecording() {
+		t.Error("the untraced query ended the span of its context")
+	}
+}
@@ -0,0 +1,136 @@
+package odj
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TxOptions configures a transaction run with InTx.
+type TxOptions struct {
+	// IsoLevel is the isolation level, e.g. pgx.Serializable. Defaults to the server default, usually read committed.
+	IsoLevel pgx.TxIsoLevel
+	// AccessMode is pgx.ReadWrite or pgx.ReadOnly. Defaults to the server default, usually read write.
+	AccessMode pgx.TxAccessMode
+	// MaxAttempts limits how often the transaction is attempted when it fails with a serialization failure (40001)
+	// or a deadlock (40P01). Defaults to 5. Use 1 to disable retries.
+	MaxAttempts int
+	// InitialBackoff and MaxBackoff bound the randomized exponential backoff between attempts.
+	// They default to 10ms and 1s.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func (o TxOptions) withDefaults() TxOptions {
+	if o.MaxAttempts < 1 {
+		o.MaxAttempts = 5
+	}
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = 10 * time.Millisecond
+	}
+	if o.MaxBackoff < o.InitialBackoff {
+		o.MaxBackoff = max(time.Second, o.InitialBackoff)
+	}
+	return o
+}
+
+type pgTxCtxKey struct{}
+
+// InTx runs fn in a transaction that is committed if fn returns nil and rolled back otherwise.
+// The context passed to fn carries the transaction. If it fails with a serialization failure or a deadlock,
+// the whole transaction including fn is retried with backoff, so fn must not have side effects outside the database.
+// Every attempt is traced as its own span.
+//
+// If ctx already carries a transaction, fn instead runs in a savepoint of that transaction which is released
+// if fn returns nil and rolled back to otherwise. opts are ignored then, and retrying is left to the outermost InTx.
+func InTx(ctx context.Context, pool *pgxpool.Pool, opts TxOptions, fn func(ctx context.Context, tx pgx.Tx) error) error {
+	if tx, ok := TxFromContext(ctx); ok {
+		return inSavepoint(ctx, pool, tx, fn)
+	}
+
+	opts = opts.withDefaults()
+	backoff := opts.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := inTxAttempt(ctx, pool, opts, attempt, fn)
+		if err == nil || attempt >= opts.MaxAttempts || !pgRetryable(err) {
+			return err
+		}
+
+		timer := time.NewTimer(backoff/2 + rand.N(backoff/2+1))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, opts.MaxBackoff)
+	}
+}
+
+func inTxAttempt(ctx context.Context, pool *pgxpool.Pool, opts TxOptions, attempt int, fn func(ctx context.Context, tx pgx.Tx) error) (err error) {
+	ctx, span := pgStartSpan(ctx, pool, "transaction",
+		attribute.Int("db.transaction.attempt", attempt),
+		attribute.String("db.transaction.isolation_level", string(opts.IsoLevel)),
+		attribute.String("db.transaction.access_mode", string(opts.AccessMode)),
+	)
+	defer func() { pgEndSpan(span, err) }()
+
+	tx, err := pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: opts.IsoLevel, AccessMode: opts.AccessMode})
+	if err != nil {
+		return fmt.Errorf("failed to begin tx: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if err := fn(ContextWithTx(ctx, tx), tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit tx: %w", err)
+	}
+	return nil
+}
+
+func inSavepoint(ctx context.Context, pool *pgxpool.Pool, tx pgx.Tx, fn func(ctx context.Context, tx pgx.Tx) error) (err error) {
+	ctx, span := pgStartSpan(ctx, pool, "savepoint")
+	defer func() { pgEndSpan(span, err) }()
+
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create savepoint: %w", err)
+	}
+	defer func() { _ = sp.Rollback(ctx) }()
+
+	if err := fn(ContextWithTx(ctx, sp), sp); err != nil {
+		return err
+	}
+
+	if err := sp.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to release savepoint: %w", err)
+	}
+	return nil
+}
+
+// pgRetryable reports whether err is a serialization failure or a deadlock, after which a transaction can be retried.
+func pgRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01")
+}
+
+// pgStartSpan starts a client span using the tracer provider configured for pool.
+func pgStartSpan(ctx context.Context, pool *pgxpool.Pool, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	cfg := pool.Config().ConnConfig
+	t, ok := cfg.Tracer.(*pgTracer)
+	if !ok {
+		t = &pgTracer{}
+	}
+	return t.start(ctx, name, &cfg.Config, attrs...)
+}
@@ -0,0 +1,238 @@
+package odj
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pedramktb/go-ctxslog"
+	"github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SchedulerOption configures a Scheduler.
+type SchedulerOption func(*Scheduler)
+
+// SchedulerWithTable sets the table, optionally schema qualified, in which the scheduler records its runs.
+// Defaults to "odj_scheduled_jobs". The table is created if it does not exist.
+func SchedulerWithTable(table string) SchedulerOption {
+	return func(s *Scheduler) {
+		s.table = pgx.Identifier(strings.Split(table, ".")).Sanitize()
+	}
+}
+
+// Scheduler runs periodic jobs on exactly one of several replicas. Every tick of a job is claimed in a table under
+// an advisory lock before the job runs, so that replicas with skewed clocks do not run the same tick twice,
+// and the duration and outcome of the run are recorded once it returns. A panicking job is recorded as failed.
+// Ticks are aligned to the wall clock, e.g. an hourly job runs at the full hour.
+type Scheduler struct {
+	pool  *pgxpool.Pool
+	table string
+
+	mu      sync.Mutex
+	jobs    []*schedulerJob
+	started bool
+	wg      sync.WaitGroup
+	done    chan struct{}
+}
+
+type schedulerJob struct {
+	name     string
+	schedule cron.Schedule
+	fn       func(ctx context.Context) error
+}
+
+// NewScheduler returns a Scheduler that coordinates through pool. Register jobs with Cron and Every before calling Start.
+func NewScheduler(pool *pgxpool.Pool, opts ...SchedulerOption) *Scheduler {
+	s := &Scheduler{
+		pool:  pool,
+		table: pgx.Identifier{"odj_scheduled_jobs"}.Sanitize(),
+		done:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Cron registers a job that runs on a standard five field cron expression, e.g. "*/15 * * * *",
+// or a descriptor such as "@daily". Expressions are evaluated in the local time zone, which Bootstrap sets to UTC,
+// unless prefixed with e.g. "CRON_TZ=Europe/Berlin ".
+func (s *Scheduler) Cron(name, spec string, fn func(ctx context.Context) error) error {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return fmt.Errorf("invalid cron expression for job %s: %w", name, err)
+	}
+	return s.add(name, schedule, fn)
+}
+
+// Every registers a job that runs every interval, aligned to multiples of interval since the Unix epoch.
+func (s *Scheduler) Every(name string, interval time.Duration, fn func(ctx context.Context) error) error {
+	if interval <= 0 {
+		return fmt.Errorf("interval of job %s must be positive, got %s", name, interval)
+	}
+	return s.add(name, intervalSchedule(interval), fn)
+}
+
+func (s *Scheduler) add(name string, schedule cron.Schedule, fn func(ctx context.Context) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return fmt.Errorf("cannot add job %s to a started scheduler", name)
+	}
+	for _, j := range s.jobs {
+		if j.name == name {
+			return fmt.Errorf("job %s is already registered", name)
+		}
+	}
+	s.jobs = append(s.jobs, &schedulerJob{name: name, schedule: schedule, fn: fn})
+	return nil
+}
+
+// Start creates the run table if needed and runs the registered jobs in the background until ctx is cancelled,
+// e.g. on shutdown of the context returned by Bootstrap. Running jobs see their context cancelled then,
+// and if ctx derives from the context returned by Bootstrap, shutdown waits for them to return.
+func (s *Scheduler) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return errors.New("scheduler is already started")
+	}
+
+	if _, err := s.pool.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	name text PRIMARY KEY,
+	last_tick timestamptz NOT NULL,
+	last_started_at timestamptz NOT NULL,
+	last_finished_at timestamptz,
+	last_duration_ms bigint,
+	last_outcome text,
+	last_error text
+)`, s.table)); err != nil {
+		return fmt.Errorf("failed to create scheduler table: %w", err)
+	}
+
+	s.started = true
+	for _, j := range s.jobs {
+		s.wg.Go(func() { s.loop(ctx, j) })
+	}
+	go func() {
+		s.wg.Wait()
+		close(s.done)
+	}()
+	onShutdown(ctx, func(ctx context.Context) error {
+		select {
+		case <-s.done:
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("scheduled jobs did not return in time: %w", ctx.Err())
+		}
+	})
+	return nil
+}
+
+// Done is closed once the scheduler was started, its context cancelled and all running jobs have returned.
+func (s *Scheduler) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Scheduler) loop(ctx context.Context, j *schedulerJob) {
+	next := j.schedule.Next(time.Now())
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		s.tick(ctx, j, next)
+
+		// Ticks missed while the job ran are skipped.
+		next = j.schedule.Next(time.Now())
+	}
+}
+
+func (s *Scheduler) tick(ctx context.Context, j *schedulerJob, tick time.Time) {
+	ctx, span := otel.Tracer("github.com/pedramktb/go-odj/scheduler").Start(ctx, "job "+j.name,
+		trace.WithNewRoot(),
+		trace.WithAttributes(
+			attribute.String("scheduler.job", j.name),
+			attribute.String("scheduler.tick", tick.UTC().Format(time.RFC3339)),
+		),
+	)
+	defer span.End()
+	logger := ctxslog.FromContext(ctx).With(slog.String("job", j.name), slog.Time("tick", tick))
+
+	// The tick is claimed in a short transaction of its own, so that the job holds no connection while it runs
+	// and its failure cannot roll back the claim, which would let a replica with a lagging clock run the tick again.
+	var claimed bool
+	_, err := RunWithPgLockErr(ctx, s.pool, "odj-scheduler:"+j.name, func(ctx context.Context) error {
+		tx, _ := TxFromContext(ctx)
+		tag, err := tx.Exec(ctx, fmt.Sprintf(`INSERT INTO %s AS j (name, last_tick, last_started_at) VALUES ($1, $2, now())
+ON CONFLICT (name) DO UPDATE SET last_tick = EXCLUDED.last_tick, last_started_at = now(),
+	last_finished_at = NULL, last_duration_ms = NULL, last_outcome = NULL, last_error = NULL
+WHERE j.last_tick < EXCLUDED.last_tick`, s.table), j.name, tick)
+		if err != nil {
+			return fmt.Errorf("failed to claim tick: %w", err)
+		}
+		claimed = tag.RowsAffected() == 1
+		return nil
+	})()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		logger.ErrorContext(ctx, "failed to claim scheduled job tick", slog.Any("err", err))
+		return
+	}
+	if !claimed {
+		span.SetAttributes(attribute.String("scheduler.outcome", "skipped"))
+		logger.DebugContext(ctx, "skipped scheduled job, the tick runs on another replica")
+		return
+	}
+
+	start := time.Now()
+	err = j.call(ctx)
+	duration := time.Since(start)
+	outcome, errMsg := "succeeded", ""
+	if err != nil {
+		outcome, errMsg = "failed", err.Error()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, errMsg)
+		logger.ErrorContext(ctx, "scheduled job failed", slog.Duration("duration", duration), slog.Any("err", err))
+	} else {
+		logger.InfoContext(ctx, "scheduled job succeeded", slog.Duration("duration", duration))
+	}
+	span.SetAttributes(attribute.String("scheduler.outcome", outcome))
+
+	recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	if _, err := s.pool.Exec(recordCtx, fmt.Sprintf(`UPDATE %s SET last_finished_at = now(), last_duration_ms = $3,
+	last_outcome = $4, last_error = NULLIF($5, '') WHERE name = $1 AND last_tick = $2`, s.table),
+		j.name, tick, duration.Milliseconds(), outcome, errMsg); err != nil {
+		logger.WarnContext(ctx, "failed to record scheduled job outcome", slog.Any("err", err))
+	}
+}
+
+// call runs the job, converting a panic into an error that carries the stack trace of the panic.
+func (j *schedulerJob) call(ctx context.Context) (err error) {
+	defer recoverAsErr(ctx, slog.String("job", j.name), &err)
+	return j.fn(ctx)
+}
+
+// intervalSchedule fires at multiples of its duration since the Unix epoch, so that all replicas agree on the ticks.
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	d := time.Duration(s)
+	return time.Unix(0, (t.UnixNano()/int64(d)+1)*int64(d))
+}